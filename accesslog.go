@@ -0,0 +1,66 @@
+package zaphttplog
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// combinedLogTimeFormat is the format of the %t field in the Apache Combined Log
+// Format.
+const combinedLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// writeAccessLog writes a line for the request to w in the Apache Combined Log
+// Format, i.e.:
+//
+//	%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-Agent}i"
+//
+// requestURI is logged in place of r.RequestURI, e.g. with masked path
+// segments, and start is the time the request was received.
+func writeAccessLog(w io.Writer, r *http.Request, requestURI string, status, byteCnt int, start time.Time) {
+	host := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		host = h
+	}
+
+	user := "-"
+	if u, _, ok := r.BasicAuth(); ok && u != "" {
+		user = u
+	}
+
+	size := "-"
+	if byteCnt > 0 {
+		size = strconv.Itoa(byteCnt)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(host)
+	buf.WriteString(" - ")
+	buf.WriteString(user)
+	buf.WriteString(" [")
+	buf.WriteString(start.Format(combinedLogTimeFormat))
+	buf.WriteString("] ")
+	buf.WriteString(strconv.Quote(r.Method + " " + requestURI + " " + r.Proto))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.Itoa(status))
+	buf.WriteByte(' ')
+	buf.WriteString(size)
+	buf.WriteByte(' ')
+	buf.WriteString(quoteOrDash(r.Referer()))
+	buf.WriteByte(' ')
+	buf.WriteString(quoteOrDash(r.UserAgent()))
+	buf.WriteByte('\n')
+
+	// Access logging is best-effort, it shouldn't affect the request.
+	_, _ = w.Write(buf.Bytes())
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
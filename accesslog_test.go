@@ -0,0 +1,87 @@
+package zaphttplog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestWriteAccessLog(t *testing.T) {
+	start := time.Date(2023, time.July, 19, 13, 55, 36, 0, time.FixedZone("", -7*60*60))
+
+	tests := []struct {
+		desc    string
+		req     func() *http.Request
+		status  int
+		byteCnt int
+		want    string
+	}{
+		{
+			desc: "full",
+			req: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/apache_pb.gif?x=1", nil)
+				r.RemoteAddr = "127.0.0.1:5555"
+				r.SetBasicAuth("frank", "password")
+				r.Header.Set("Referer", "http://www.example.com/start.html")
+				r.Header.Set("User-Agent", "Mozilla/4.08 [en] (Win98; I ;Nav)")
+				return r
+			},
+			status:  http.StatusOK,
+			byteCnt: 2326,
+			want:    `127.0.0.1 - frank [19/Jul/2023:13:55:36 -0700] "GET /apache_pb.gif?x=1 HTTP/1.1" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"` + "\n",
+		},
+		{
+			desc: "minimal",
+			req: func() *http.Request {
+				r := httptest.NewRequest(http.MethodPost, "/", nil)
+				r.RemoteAddr = "10.0.0.1"
+				return r
+			},
+			status:  http.StatusNoContent,
+			byteCnt: 0,
+			want:    `10.0.0.1 - - [19/Jul/2023:13:55:36 -0700] "POST / HTTP/1.1" 204 - "-" "-"` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			var buf bytes.Buffer
+			req := test.req()
+			writeAccessLog(&buf, req, req.RequestURI, test.status, test.byteCnt, start)
+			if got := buf.String(); got != test.want {
+				t.Errorf("writeAccessLog() wrote %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareAccessLogWriter(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	var buf bytes.Buffer
+	h := NewMiddleware(zap.New(core), WithAccessLogWriter(&buf))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/items?x=1", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("User-Agent", "test-agent")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if logs.Len() != 1 {
+		t.Errorf("%d lines were logged, want 1", logs.Len())
+	}
+	got := buf.String()
+	if !strings.HasPrefix(got, "10.0.0.1 - - [") {
+		t.Errorf("access log line %q doesn't start with the client IP", got)
+	}
+	if want := `] "POST /items?x=1 HTTP/1.1" 201 7 "-" "test-agent"` + "\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("access log line = %q, want it to end with %q", got, want)
+	}
+}
@@ -0,0 +1,31 @@
+package zaphttplog
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/baggage"
+	"go.uber.org/zap/zapcore"
+)
+
+// baggageField returns a field logging the members of the OpenTelemetry baggage
+// in ctx with the given keys as the "baggage" object, or nil if there are none.
+func baggageField(ctx context.Context, keys []string) objEncoderFn {
+	bag := baggage.FromContext(ctx)
+	var members []baggage.Member
+	for _, k := range keys {
+		if m := bag.Member(k); m.Key() != "" {
+			members = append(members, m)
+		}
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	return func(enc zapcore.ObjectEncoder) error {
+		return enc.AddObject("baggage", zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+			for _, m := range members {
+				enc.AddString(m.Key(), m.Value())
+			}
+			return nil
+		}))
+	}
+}
@@ -0,0 +1,34 @@
+package zaphttplog
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.opentelemetry.io/otel/baggage"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestBaggageField(t *testing.T) {
+	bag, err := baggage.Parse("tenant=acme,plan=pro,other=ignored")
+	if err != nil {
+		t.Fatalf("baggage.Parse: %v", err)
+	}
+	ctx := baggage.ContextWithBaggage(context.Background(), bag)
+
+	if f := baggageField(context.Background(), []string{"tenant"}); f != nil {
+		t.Error("baggageField() without baggage returned a field, want nil")
+	}
+	if f := baggageField(ctx, []string{"missing"}); f != nil {
+		t.Error("baggageField() without matching keys returned a field, want nil")
+	}
+
+	enc := zapcore.NewMapObjectEncoder()
+	if err := baggageField(ctx, []string{"tenant", "plan", "missing"})(enc); err != nil {
+		t.Fatalf("failed to encode field: %v", err)
+	}
+	want := map[string]interface{}{"tenant": "acme", "plan": "pro"}
+	if got := enc.Fields["baggage"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("baggage = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,52 @@
+package zaphttplog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxDecodedBodySize bounds the size of decoded response bodies, so a small
+// captured body can't decompress to an arbitrarily large one.
+const maxDecodedBodySize = 16 << 10
+
+// decodeBody decodes a captured response body with the given Content-Encoding.
+// Captured bodies may be truncated, so as much as could be decoded is returned.
+// ok is false if the encoding isn't supported, e.g. for Brotli ("br"), or the
+// body couldn't be decoded at all, in which case body is returned as-is.
+func decodeBody(encoding string, body []byte) (decoded []byte, ok bool) {
+	var r io.Reader
+	var err error
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, true
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(body))
+	case "zstd":
+		var d *zstd.Decoder
+		d, err = zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1))
+		if err == nil {
+			defer d.Close()
+			r = d
+		}
+	default:
+		return body, false
+	}
+	if err != nil {
+		return body, false
+	}
+
+	// Errors are expected for truncated bodies, so they're only reported if
+	// nothing was decoded.
+	decoded, err = io.ReadAll(io.LimitReader(r, maxDecodedBodySize))
+	if err != nil && len(decoded) == 0 {
+		return body, false
+	}
+	return decoded, true
+}
@@ -0,0 +1,101 @@
+package zaphttplog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func encodeBody(t *testing.T, encoding string, body string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatalf("zstd.NewWriter: %v", err)
+		}
+		w = zw
+	default:
+		return []byte(body)
+	}
+	if _, err := io.WriteString(w, body); err != nil {
+		t.Fatalf("failed to encode body: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to encode body: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestMiddlewareResponseBodyDecoding(t *testing.T) {
+	const body = `{"error": "invalid request"}`
+	tests := []struct {
+		encoding     string
+		wantBody     interface{}
+		wantEncoding interface{}
+	}{
+		{encoding: "gzip", wantBody: body},
+		{encoding: "deflate", wantBody: body},
+		{encoding: "zstd", wantBody: body},
+		{encoding: "br", wantBody: "not really brotli", wantEncoding: "br"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.encoding, func(t *testing.T) {
+			encoded := encodeBody(t, test.encoding, body)
+			if test.encoding == "br" {
+				encoded = []byte("not really brotli")
+			}
+
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithResponseBodyDecoding(true))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", test.encoding)
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write(encoded)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			httpResp := loggedObject(t, logs, "httpResponse")
+			if got := httpResp["body"]; got != test.wantBody {
+				t.Errorf("httpResponse[%q] = %v, want %v", "body", got, test.wantBody)
+			}
+			if got := httpResp["bodyEncoding"]; got != test.wantEncoding {
+				t.Errorf("httpResponse[%q] = %v, want %v", "bodyEncoding", got, test.wantEncoding)
+			}
+		})
+	}
+}
+
+func TestDecodeBodyTruncated(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 100)
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(body)
+	w.Close()
+	// Drop the gzip trailer, like when the captured body is truncated.
+	truncated := buf.Bytes()[:buf.Len()-8]
+
+	got, ok := decodeBody("gzip", truncated)
+	if !ok {
+		t.Fatal("decodeBody() failed for a truncated body")
+	}
+	if !bytes.HasPrefix(body, got) || len(got) == 0 {
+		t.Errorf("decodeBody() = %q, want a prefix of the body", got)
+	}
+}
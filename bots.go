@@ -0,0 +1,33 @@
+package zaphttplog
+
+import "regexp"
+
+// DefaultBotPatterns returns patterns matching the User-Agent of common
+// crawlers and command-line HTTP clients, for use with WithBotDetectionLogging.
+// A new slice is returned on each call, so it can be extended.
+func DefaultBotPatterns() []*regexp.Regexp {
+	return []*regexp.Regexp{
+		regexp.MustCompile(`(?i)googlebot`),
+		regexp.MustCompile(`(?i)bingbot`),
+		regexp.MustCompile(`(?i)duckduckbot`),
+		regexp.MustCompile(`(?i)baiduspider`),
+		regexp.MustCompile(`(?i)yandexbot`),
+		regexp.MustCompile(`(?i)slurp`),
+		regexp.MustCompile(`(?i)facebookexternalhit`),
+		regexp.MustCompile(`(?i)^curl/`),
+		regexp.MustCompile(`(?i)^wget/`),
+		regexp.MustCompile(`(?i)^python-requests/`),
+		regexp.MustCompile(`(?i)^go-http-client/`),
+		regexp.MustCompile(`(?i)\b(bot|crawler|spider)\b`),
+	}
+}
+
+// isBot reports whether userAgent matches any of the patterns.
+func isBot(userAgent string, patterns []*regexp.Regexp) bool {
+	for _, p := range patterns {
+		if p.MatchString(userAgent) {
+			return true
+		}
+	}
+	return false
+}
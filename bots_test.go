@@ -0,0 +1,43 @@
+package zaphttplog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestMiddlewareBotDetection(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      bool
+	}{
+		{userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", want: true},
+		{userAgent: "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", want: true},
+		{userAgent: "curl/8.1.2", want: true},
+		{userAgent: "Wget/1.21.4", want: true},
+		{userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/118.0", want: false},
+		{userAgent: "", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.userAgent, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithBotDetectionLogging(DefaultBotPatterns()))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("User-Agent", test.userAgent)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			got, ok := loggedObject(t, logs, "httpRequest")["isBot"]
+			if ok != test.want {
+				t.Errorf("httpRequest has isBot = %t, want %t", ok, test.want)
+			}
+			if ok && got != true {
+				t.Errorf("httpRequest[%q] = %v, want true", "isBot", got)
+			}
+		})
+	}
+}
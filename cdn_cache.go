@@ -0,0 +1,45 @@
+package zaphttplog
+
+import (
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// defaultCDNCacheHitValues are the cache statuses reported as hits when no
+// others are set with WithCDNCacheHitValues. They cover Cloudflare's
+// CF-Cache-Status values for responses served from its cache, and the "HIT" of
+// Fastly, Varnish and others.
+var defaultCDNCacheHitValues = []string{"HIT", "STALE", "UPDATING", "REVALIDATED"}
+
+// cdnCacheFields returns the "cdnCacheStatus" and "cdnCacheHit" fields for the
+// given cache status header value, or nil if it's empty.
+func cdnCacheFields(status string, hitValues []string) []objEncoderFn {
+	if status == "" {
+		return nil
+	}
+	if len(hitValues) == 0 {
+		hitValues = defaultCDNCacheHitValues
+	}
+	hit := isCDNCacheHit(status, hitValues)
+	return []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("cdnCacheStatus", status); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddBool("cdnCacheHit", hit); return nil },
+	}
+}
+
+// isCDNCacheHit returns whether status is one of hitValues, ignoring case. For
+// statuses with a value per cache layer, like Fastly's "MISS, HIT", the last
+// value, from the cache closest to the client, is used.
+func isCDNCacheHit(status string, hitValues []string) bool {
+	if idx := strings.LastIndexByte(status, ','); idx >= 0 {
+		status = status[idx+1:]
+	}
+	status = strings.TrimSpace(status)
+	for _, v := range hitValues {
+		if strings.EqualFold(status, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package zaphttplog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestIsCDNCacheHit(t *testing.T) {
+	tests := []struct {
+		status    string
+		hitValues []string
+		want      bool
+	}{
+		{status: "HIT", hitValues: defaultCDNCacheHitValues, want: true},
+		{status: "hit", hitValues: defaultCDNCacheHitValues, want: true},
+		{status: "MISS", hitValues: defaultCDNCacheHitValues, want: false},
+		{status: "DYNAMIC", hitValues: defaultCDNCacheHitValues, want: false},
+		{status: "MISS, HIT", hitValues: defaultCDNCacheHitValues, want: true},
+		{status: "HIT, MISS", hitValues: defaultCDNCacheHitValues, want: false},
+		{status: "TCP_HIT", hitValues: []string{"TCP_HIT", "TCP_MEM_HIT"}, want: true},
+		{status: "HIT", hitValues: []string{"TCP_HIT"}, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.status, func(t *testing.T) {
+			if got := isCDNCacheHit(test.status, test.hitValues); got != test.want {
+				t.Errorf("isCDNCacheHit(%q, %q) = %t, want %t", test.status, test.hitValues, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareCDNCacheStatusLogging(t *testing.T) {
+	tests := []struct {
+		status  string
+		wantHit bool
+	}{
+		{status: "HIT", wantHit: true},
+		{status: "MISS"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.status, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithCDNCacheStatusLogging("CF-Cache-Status"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("CF-Cache-Status", test.status)
+				w.WriteHeader(http.StatusOK)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			httpResp := loggedObject(t, logs, "httpResponse")
+			if got := httpResp["cdnCacheStatus"]; got != test.status {
+				t.Errorf("httpResponse[%q] = %v, want %q", "cdnCacheStatus", got, test.status)
+			}
+			if got := httpResp["cdnCacheHit"]; got != test.wantHit {
+				t.Errorf("httpResponse[%q] = %v, want %t", "cdnCacheHit", got, test.wantHit)
+			}
+		})
+	}
+}
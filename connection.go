@@ -0,0 +1,157 @@
+package zaphttplog
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// NewConnectionMiddleware is like NewMiddleware, but is meant for servers with
+// long-lived connections, like WebSockets or HTTP/2 connections multiplexing
+// many short-lived streams, where a line per request is too noisy. It writes a
+// "connection opened" line for the first request seen from each remote address,
+// and a "connection closed" line for each of them once the context set with
+// WithServerContext is done. Per-request lines are still written, but at Debug
+// level.
+//
+// The "connection closed" lines of NewConnectionMiddleware only mean that the
+// server shut down: to also log connections as they close, use
+// NewConnectionLogger and install its ConnState method as the server's
+// ConnState hook.
+//
+// Like RequestCountHeader, connections are identified by their remote address
+// and tracking is best-effort: to bound memory use, all connections are
+// forgotten, without a closing line, after a large number of distinct ones.
+func NewConnectionMiddleware(logger *zap.Logger, options ...Option) Middleware {
+	return NewConnectionLogger(logger, options...).Middleware
+}
+
+// ConnectionLogger logs connections like NewConnectionMiddleware, and, with
+// its ConnState method installed as http.Server.ConnState, also logs them as
+// they close.
+type ConnectionLogger struct {
+	logger *zap.Logger
+	conns  *connTracker
+	mw     Middleware
+}
+
+// NewConnectionLogger returns a ConnectionLogger writing to logger, see
+// NewConnectionMiddleware.
+func NewConnectionLogger(logger *zap.Logger, options ...Option) *ConnectionLogger {
+	opts := newOptions(options)
+	opts.warnConflicts(logger)
+	c := &ConnectionLogger{
+		logger: opts.withDefaultFields(logger),
+		conns:  newConnTracker(),
+		mw:     newMiddleware(logger, opts),
+	}
+	if opts.ServerContext != nil {
+		go func() {
+			<-opts.ServerContext.Done()
+			for addr, conn := range c.conns.reset() {
+				c.logClosed(addr, conn)
+			}
+		}()
+	}
+	return c
+}
+
+// Middleware logs the requests to next, at Debug level, and writes a
+// "connection opened" line for the first request of each connection.
+func (c *ConnectionLogger) Middleware(next http.Handler) http.Handler {
+	logged := c.mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetRouteLogLevel(r.Context(), zapcore.DebugLevel)
+		next.ServeHTTP(w, r)
+	}))
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		conn := c.conns.get(r.RemoteAddr, r.Proto)
+		conn.once.Do(func() {
+			c.logger.Info("connection opened", zap.String("remoteIP", r.RemoteAddr), zap.String("proto", r.Proto))
+		})
+		logged.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// ConnState is meant to be installed as http.Server.ConnState. It writes a
+// "connection closed" line when a connection that served requests closes.
+// Hijacked connections, e.g. upgraded to WebSockets, are no longer managed by
+// the server, so they're forgotten without a closing line.
+func (c *ConnectionLogger) ConnState(netConn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateClosed:
+		addr := netConn.RemoteAddr().String()
+		if conn, ok := c.conns.remove(addr); ok {
+			c.logClosed(addr, conn)
+		}
+	case http.StateHijacked:
+		c.conns.remove(netConn.RemoteAddr().String())
+	}
+}
+
+func (c *ConnectionLogger) logClosed(addr string, conn *connState) {
+	c.logger.Info("connection closed",
+		zap.String("remoteIP", addr),
+		zap.String("proto", conn.proto),
+		zap.Duration("connDuration", time.Since(conn.opened)))
+}
+
+// connState is the state of a connection tracked by NewConnectionMiddleware.
+type connState struct {
+	// once writes the line for the opening of the connection.
+	once   sync.Once
+	opened time.Time
+	proto  string
+}
+
+// connTracker tracks the connections seen by NewConnectionMiddleware, keyed by
+// remote address.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[string]*connState
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[string]*connState)}
+}
+
+// get returns the state of the given connection, adding it if it's new.
+func (c *connTracker) get(remoteAddr, proto string) *connState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conn, ok := c.conns[remoteAddr]
+	if ok {
+		return conn
+	}
+	if len(c.conns) >= maxTrackedConns {
+		c.conns = make(map[string]*connState)
+	}
+	conn = &connState{opened: time.Now(), proto: proto}
+	c.conns[remoteAddr] = conn
+	return conn
+}
+
+// remove forgets the given connection, and returns it if it was tracked.
+func (c *connTracker) remove(remoteAddr string) (*connState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conn, ok := c.conns[remoteAddr]
+	delete(c.conns, remoteAddr)
+	return conn, ok
+}
+
+// reset forgets all tracked connections and returns them.
+func (c *connTracker) reset() map[string]*connState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conns := c.conns
+	c.conns = make(map[string]*connState)
+	return conns
+}
@@ -0,0 +1,98 @@
+package zaphttplog
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestConnectionMiddleware(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mw := NewConnectionMiddleware(zap.New(core), WithServerContext(ctx))
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if got := logs.FilterMessage("connection opened").Len(); got != 1 {
+		t.Errorf("%d connection opened lines were logged, want 1", got)
+	}
+	if got := logs.FilterLevelExact(zapcore.DebugLevel).Len(); got != 2 {
+		t.Errorf("%d request lines were logged at Debug level, want 2", got)
+	}
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for logs.FilterMessage("connection closed").Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no connection closed line was logged after the server context was cancelled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := logs.FilterMessage("connection closed").All()[0].ContextMap()["remoteIP"]; got != "10.0.0.1:1234" {
+		t.Errorf("remoteIP = %v, want %q", got, "10.0.0.1:1234")
+	}
+}
+
+func TestConnectionMiddlewareAppliesOptionsOnce(t *testing.T) {
+	applied := 0
+	countApplied := func(*Options) { applied++ }
+	NewConnectionMiddleware(zap.NewNop(), countApplied)
+
+	if applied != 1 {
+		t.Errorf("option applied %d times, want 1", applied)
+	}
+}
+
+func TestConnectionLoggerConnState(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cl := NewConnectionLogger(zap.New(core), WithServerContext(ctx))
+	srv := httptest.NewUnstartedServer(cl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+	srv.Config.ConnState = cl.ConnState
+	srv.Start()
+
+	client := srv.Client()
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	resp.Body.Close()
+	client.CloseIdleConnections()
+	srv.Close()
+
+	closed := logs.FilterMessage("connection closed").All()
+	if len(closed) != 1 {
+		t.Fatalf("%d connection closed lines were logged, want 1", len(closed))
+	}
+	opened := logs.FilterMessage("connection opened").All()
+	if len(opened) != 1 {
+		t.Fatalf("%d connection opened lines were logged, want 1", len(opened))
+	}
+	if got, want := closed[0].ContextMap()["remoteIP"], opened[0].ContextMap()["remoteIP"]; got != want {
+		t.Errorf("closed connection remoteIP = %v, want %v", got, want)
+	}
+
+	// The connection is already closed, so it isn't logged again on shutdown.
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	if got := logs.FilterMessage("connection closed").Len(); got != 1 {
+		t.Errorf("%d connection closed lines were logged after shutdown, want 1", got)
+	}
+}
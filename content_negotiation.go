@@ -0,0 +1,46 @@
+package zaphttplog
+
+import (
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// contentNegotiationFields returns the "responseContentType" field, and the
+// "contentNegotiationMismatch" field if the response's media type isn't one the
+// Accept header of the request allows.
+func contentNegotiationFields(accept, contentType string) []objEncoderFn {
+	if contentType == "" {
+		return nil
+	}
+	fields := []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("responseContentType", contentType); return nil },
+	}
+	if accept != "" && !mediaTypeAccepted(accept, mediaType(contentType)) {
+		fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddBool("contentNegotiationMismatch", true); return nil })
+	}
+	return fields
+}
+
+// mediaType returns the lowercase media type of a Content-Type header value, or
+// of a media range in an Accept header, without its parameters.
+func mediaType(v string) string {
+	v, _, _ = strings.Cut(v, ";")
+	return strings.ToLower(strings.TrimSpace(v))
+}
+
+// mediaTypeAccepted reports whether typ matches any of the media ranges in the
+// given Accept header, like "application/json", "text/*" or "*/*". Quality
+// values are ignored.
+func mediaTypeAccepted(accept, typ string) bool {
+	major, _, _ := strings.Cut(typ, "/")
+	for _, r := range strings.Split(accept, ",") {
+		switch r = mediaType(r); {
+		case r == "*/*", r == typ:
+			return true
+		case strings.HasSuffix(r, "/*") && strings.TrimSuffix(r, "/*") == major:
+			return true
+		}
+	}
+	return false
+}
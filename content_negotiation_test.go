@@ -0,0 +1,54 @@
+package zaphttplog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestMediaTypeAccepted(t *testing.T) {
+	tests := []struct {
+		accept string
+		typ    string
+		want   bool
+	}{
+		{accept: "application/json", typ: "application/json", want: true},
+		{accept: "application/json", typ: "text/plain", want: false},
+		{accept: "Application/JSON; charset=utf-8", typ: "application/json", want: true},
+		{accept: "text/html, application/xhtml+xml;q=0.9, */*;q=0.8", typ: "image/png", want: true},
+		{accept: "text/*", typ: "text/plain", want: true},
+		{accept: "text/*", typ: "application/json", want: false},
+	}
+
+	for _, test := range tests {
+		if got := mediaTypeAccepted(test.accept, test.typ); got != test.want {
+			t.Errorf("mediaTypeAccepted(%q, %q) = %t, want %t", test.accept, test.typ, got, test.want)
+		}
+	}
+}
+
+func TestMiddlewareContentNegotiationLogging(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithContentNegotiationLogging(true))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok"))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/json")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := loggedObject(t, logs, "httpRequest")["acceptHeader"]; got != "application/json" {
+		t.Errorf("httpRequest[%q] = %v, want %q", "acceptHeader", got, "application/json")
+	}
+	httpResp := loggedObject(t, logs, "httpResponse")
+	if got := httpResp["responseContentType"]; got != "text/plain; charset=utf-8" {
+		t.Errorf("httpResponse[%q] = %v, want %q", "responseContentType", got, "text/plain; charset=utf-8")
+	}
+	if got := httpResp["contentNegotiationMismatch"]; got != true {
+		t.Errorf("httpResponse[%q] = %v, want true", "contentNegotiationMismatch", got)
+	}
+}
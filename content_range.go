@@ -0,0 +1,63 @@
+package zaphttplog
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// parseContentRange parses a Content-Range response header like
+// "bytes 0-499/1234". total is -1 if the complete length is unknown, i.e. "*".
+func parseContentRange(v string) (start, end, total int64, ok bool) {
+	spec, found := strings.CutPrefix(v, "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	rng, size, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	startStr, endStr, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, 0, false
+	}
+	end, err = strconv.ParseInt(endStr, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, 0, false
+	}
+	if size == "*" {
+		return start, end, -1, true
+	}
+	total, err = strconv.ParseInt(size, 10, 64)
+	if err != nil || total <= end {
+		return 0, 0, 0, false
+	}
+	return start, end, total, true
+}
+
+// contentRangeFields logs the byte range of a 206 Partial Content response, or
+// nothing if its Content-Range header can't be parsed.
+func contentRangeFields(header http.Header) []objEncoderFn {
+	start, end, total, ok := parseContentRange(header.Get("Content-Range"))
+	if !ok {
+		return nil
+	}
+	return []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddInt64("rangeStart", start); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddInt64("rangeEnd", end); return nil },
+		func(enc zapcore.ObjectEncoder) error {
+			if total < 0 {
+				enc.AddString("totalSize", "*")
+			} else {
+				enc.AddInt64("totalSize", total)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,62 @@
+package zaphttplog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		in                           string
+		wantStart, wantEnd, wantSize int64
+		wantOK                       bool
+	}{
+		{in: "bytes 0-499/1234", wantStart: 0, wantEnd: 499, wantSize: 1234, wantOK: true},
+		{in: "bytes 500-999/*", wantStart: 500, wantEnd: 999, wantSize: -1, wantOK: true},
+		{in: "bytes */1234"},
+		{in: "bytes 500-499/1234"},
+		{in: "bytes 0-1234/1234"},
+		{in: "items 0-9/100"},
+		{in: "bytes 0-499"},
+		{in: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			start, end, size, ok := parseContentRange(test.in)
+			if ok != test.wantOK {
+				t.Fatalf("got ok = %t, want %t", ok, test.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if start != test.wantStart || end != test.wantEnd || size != test.wantSize {
+				t.Errorf("got range = %d-%d/%d, want %d-%d/%d", start, end, size, test.wantStart, test.wantEnd, test.wantSize)
+			}
+		})
+	}
+}
+
+func TestMiddlewareRangeRequestLogging(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithRangeRequestLogging(true))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.txt", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/data.txt", nil)
+	r.Header.Set("Range", "bytes=2-5")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	httpResp := loggedObject(t, logs, "httpResponse")
+	for k, want := range map[string]int64{"rangeStart": 2, "rangeEnd": 5, "totalSize": 10} {
+		if got := httpResp[k]; got != want {
+			t.Errorf("httpResponse[%q] = %v, want %d", k, got, want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package zaphttplog
+
+import (
+	"net/http"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// DeprecationRegistry reports which endpoints are deprecated, for use with
+// WithDeprecationRegistry.
+type DeprecationRegistry interface {
+	// IsDeprecated reports whether the endpoint with the given method and path
+	// is deprecated, and if so, a message about migrating off it. The path is the
+	// chi route pattern if the request matched one, like "/v1/users/{userID}".
+	IsDeprecated(method, path string) (deprecated bool, message string)
+}
+
+// MapDeprecationRegistry returns a DeprecationRegistry of the endpoints in m,
+// mapped to their migration messages. Keys are a method and path, like
+// "GET /v1/users", or just a path, which matches every method.
+func MapDeprecationRegistry(m map[string]string) DeprecationRegistry {
+	return mapDeprecationRegistry(copyMap(m))
+}
+
+type mapDeprecationRegistry map[string]string
+
+func (m mapDeprecationRegistry) IsDeprecated(method, path string) (bool, string) {
+	if msg, ok := m[method+" "+path]; ok {
+		return true, msg
+	}
+	msg, ok := m[path]
+	return ok, msg
+}
+
+// deprecationFields returns the "deprecated" and "deprecationMessage" fields if
+// the request is for a deprecated endpoint.
+func deprecationFields(r *http.Request, registry DeprecationRegistry) []objEncoderFn {
+	deprecated, msg := registry.IsDeprecated(r.Method, ChiPatternNormalizer(r))
+	if !deprecated {
+		return nil
+	}
+	fields := []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddBool("deprecated", true); return nil },
+	}
+	if msg != "" {
+		fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("deprecationMessage", msg); return nil })
+	}
+	return fields
+}
@@ -0,0 +1,51 @@
+package zaphttplog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestMiddlewareDeprecationRegistry(t *testing.T) {
+	registry := MapDeprecationRegistry(map[string]string{
+		"GET /v1/users/{userID}": "use /v2/users/{userID}",
+		"/v1/legacy":             "",
+	})
+	tests := []struct {
+		method      string
+		path        string
+		wantMessage interface{}
+		wantLogged  bool
+	}{
+		{method: http.MethodGet, path: "/v1/users/123", wantMessage: "use /v2/users/{userID}", wantLogged: true},
+		{method: http.MethodDelete, path: "/v1/users/123"},
+		{method: http.MethodPost, path: "/v1/legacy", wantLogged: true},
+		{method: http.MethodGet, path: "/v2/users/123"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			router := chi.NewRouter()
+			router.Use(NewMiddleware(zap.New(core), WithDeprecationRegistry(registry)))
+			h := func(w http.ResponseWriter, r *http.Request) {}
+			router.HandleFunc("/v1/users/{userID}", h)
+			router.HandleFunc("/v2/users/{userID}", h)
+			router.HandleFunc("/v1/legacy", h)
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(test.method, test.path, nil))
+
+			httpReq := loggedObject(t, logs, "httpRequest")
+			if _, got := httpReq["deprecated"]; got != test.wantLogged {
+				t.Errorf("httpRequest has deprecated = %t, want %t", got, test.wantLogged)
+			}
+			if got := httpReq["deprecationMessage"]; got != test.wantMessage {
+				t.Errorf("httpRequest[%q] = %v, want %v", "deprecationMessage", got, test.wantMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package zaphttplog
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// ecsResponse holds the response details logged with ElasticCommonSchema.
+type ecsResponse struct {
+	status  int
+	bytes   int
+	elapsed time.Duration
+	// fields are the response fields without an ECS equivalent.
+	fields []objEncoderFn
+}
+
+// ecsFields returns the top-level fields logging the request, and the response
+// if it's not nil, in the Elastic Common Schema. reqExtra are request fields
+// without an ECS equivalent. Without a response, the line is marked as the
+// "incoming" event, like with LogRequestStart.
+func ecsFields(r *http.Request, opts *Options, reqExtra []objEncoderFn, resp *ecsResponse) []zap.Field {
+	scheme, host, requestURL := requestTarget(r, opts)
+
+	reqFields := []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("method", r.Method); return nil },
+	}
+	if reqID := requestID(r.Context()); reqID != "" {
+		reqFields = append(reqFields, func(enc zapcore.ObjectEncoder) error { enc.AddString("id", reqID); return nil })
+	}
+	if r.ContentLength > 0 {
+		reqFields = append(reqFields, func(enc zapcore.ObjectEncoder) error { return enc.AddObject("body", ecsBytes(r.ContentLength)) })
+	}
+	reqFields = append(reqFields, optionalRequestFields(r, opts)...)
+	if !opts.Concise {
+		if f := requestHeaderField(r, opts); f != nil {
+			reqFields = append(reqFields, f)
+		}
+		if f := verboseOnlyField(r, opts); f != nil {
+			reqFields = append(reqFields, f)
+		}
+	}
+	reqFields = append(reqFields, reqExtra...)
+
+	httpFields := []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error {
+			enc.AddString("version", strconv.Itoa(r.ProtoMajor)+"."+strconv.Itoa(r.ProtoMinor))
+			return nil
+		},
+		func(enc zapcore.ObjectEncoder) error { return enc.AddObject("request", toMarshaler(reqFields)) },
+	}
+	event := []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("action", "incoming"); return nil },
+	}
+	if resp != nil {
+		respFields := append([]objEncoderFn{
+			func(enc zapcore.ObjectEncoder) error { enc.AddInt("status_code", resp.status); return nil },
+			func(enc zapcore.ObjectEncoder) error { return enc.AddObject("body", ecsBytes(int64(resp.bytes))) },
+		}, resp.fields...)
+		httpFields = append(httpFields, func(enc zapcore.ObjectEncoder) error { return enc.AddObject("response", toMarshaler(respFields)) })
+		event = []objEncoderFn{
+			// ECS durations are in nanoseconds.
+			func(enc zapcore.ObjectEncoder) error {
+				enc.AddInt64("duration", resp.elapsed.Nanoseconds())
+				return nil
+			},
+		}
+	}
+
+	urlFields := []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("full", requestURL); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("path", requestPath(r, opts)); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("scheme", scheme); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("domain", host); return nil },
+	}
+
+	if r.URL.RawQuery != "" {
+		query := redactQuery(r.URL.RawQuery, opts.QueryParamRedactKeys)
+		urlFields = append(urlFields, func(enc zapcore.ObjectEncoder) error { enc.AddString("query", query); return nil })
+	}
+
+	clientFields := []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("address", r.RemoteAddr); return nil },
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		clientFields = append(clientFields, func(enc zapcore.ObjectEncoder) error { enc.AddString("ip", ip); return nil })
+	}
+
+	fields := []zap.Field{
+		zap.Object("http", toMarshaler(httpFields)),
+		zap.Object("url", toMarshaler(urlFields)),
+		zap.Object("client", toMarshaler(clientFields)),
+		zap.Object("event", toMarshaler(event)),
+	}
+	if ua := r.UserAgent(); ua != "" {
+		fields = append(fields, zap.Object("user_agent", zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+			enc.AddString("original", ua)
+			return nil
+		})))
+	}
+	return fields
+}
+
+// ecsBytes marshals an ECS body object, with its size in bytes.
+func ecsBytes(n int64) zapcore.ObjectMarshaler {
+	return zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+		enc.AddInt64("bytes", n)
+		return nil
+	})
+}
@@ -0,0 +1,70 @@
+package zaphttplog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestMiddlewareElasticCommonSchema(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithElasticCommonSchema(true))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/things?a=b", strings.NewReader("body"))
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("User-Agent", "test-agent")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if logs.Len() != 1 {
+		t.Fatalf("%d lines were logged, want 1", logs.Len())
+	}
+	fields := logs.All()[0].ContextMap()
+	for _, key := range []string{"httpRequest", "httpResponse"} {
+		if _, ok := fields[key]; ok {
+			t.Errorf("log line has a %q field, want only ECS fields", key)
+		}
+	}
+
+	httpObj := loggedObject(t, logs, "http")
+	httpReq := httpObj["request"].(map[string]interface{})
+	resp := httpObj["response"].(map[string]interface{})
+	urlObj := loggedObject(t, logs, "url")
+	client := loggedObject(t, logs, "client")
+	event := loggedObject(t, logs, "event")
+	ua := loggedObject(t, logs, "user_agent")
+
+	tests := []struct {
+		desc string
+		got  interface{}
+		want interface{}
+	}{
+		{"http.version", httpObj["version"], "1.1"},
+		{"http.request.method", httpReq["method"], http.MethodPost},
+		{"http.request.body.bytes", httpReq["body"].(map[string]interface{})["bytes"], int64(4)},
+		{"http.response.status_code", resp["status_code"], http.StatusCreated},
+		{"http.response.body.bytes", resp["body"].(map[string]interface{})["bytes"], int64(5)},
+		{"url.full", urlObj["full"], "http://example.com/things?a=b"},
+		{"url.path", urlObj["path"], "/things"},
+		{"url.scheme", urlObj["scheme"], "http"},
+		{"url.domain", urlObj["domain"], "example.com"},
+		{"url.query", urlObj["query"], "a=b"},
+		{"client.address", client["address"], "10.0.0.1:1234"},
+		{"client.ip", client["ip"], "10.0.0.1"},
+		{"user_agent.original", ua["original"], "test-agent"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s = %v (%T), want %v (%T)", test.desc, test.got, test.got, test.want, test.want)
+		}
+	}
+	if _, ok := event["duration"].(int64); !ok {
+		t.Errorf("event.duration = %v (%T), want an int64", event["duration"], event["duration"])
+	}
+}
@@ -0,0 +1,82 @@
+package zaphttplog
+
+import (
+	"sync"
+	"time"
+)
+
+// errorRateTracker counts requests and 5xx responses in time buckets to compute
+// a rolling error rate.
+type errorRateTracker struct {
+	bucketSize time.Duration
+
+	mu      sync.Mutex
+	buckets []errorRateBucket
+}
+
+type errorRateBucket struct {
+	// id is the index of the time period the bucket currently counts, which is
+	// the time divided by the bucket size.
+	id            int64
+	total, errors int
+}
+
+func newErrorRateTracker(window time.Duration, buckets int) *errorRateTracker {
+	if buckets < 1 {
+		buckets = 1
+	}
+	bucketSize := window / time.Duration(buckets)
+	if bucketSize <= 0 {
+		bucketSize = 1
+	}
+	return &errorRateTracker{
+		bucketSize: bucketSize,
+		buckets:    make([]errorRateBucket, buckets),
+	}
+}
+
+// record counts a request finishing at now, and returns the percentage of
+// requests in the window ending at now, including this one, that were errors.
+func (e *errorRateTracker) record(now time.Time, isErr bool) float64 {
+	id := now.UnixNano() / int64(e.bucketSize)
+	n := int64(len(e.buckets))
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	b := &e.buckets[id%n]
+	if b.id != id {
+		*b = errorRateBucket{id: id}
+	}
+	b.total++
+	if isErr {
+		b.errors++
+	}
+
+	total, errors := e.sum(id)
+	return float64(errors) / float64(total) * 100
+}
+
+// errorCount returns the number of errors recorded in the window ending at now.
+func (e *errorRateTracker) errorCount(now time.Time) int {
+	id := now.UnixNano() / int64(e.bucketSize)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, errors := e.sum(id)
+	return errors
+}
+
+// sum returns the number of requests and errors in the buckets of the window
+// ending with the bucket with the given id. e.mu must be held.
+func (e *errorRateTracker) sum(id int64) (total, errors int) {
+	n := int64(len(e.buckets))
+	for _, b := range e.buckets {
+		if id-b.id < n {
+			total += b.total
+			errors += b.errors
+		}
+	}
+	return total, errors
+}
@@ -0,0 +1,62 @@
+package zaphttplog
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestErrorRateTracker(t *testing.T) {
+	tracker := newErrorRateTracker(time.Minute, 6)
+	start := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		desc  string
+		at    time.Duration
+		isErr bool
+		want  float64
+	}{
+		{desc: "first request ok", at: 0, isErr: false, want: 0},
+		{desc: "error in same bucket", at: time.Second, isErr: true, want: 50},
+		{desc: "error in a later bucket", at: 30 * time.Second, isErr: true, want: 200.0 / 3},
+		{desc: "first bucket expired", at: 65 * time.Second, isErr: false, want: 50},
+		{desc: "all buckets expired", at: 5 * time.Minute, isErr: false, want: 0},
+	}
+
+	for _, test := range tests {
+		if got := tracker.record(start.Add(test.at), test.isErr); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: got errorRatePct = %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestMiddlewareErrorRateWindow(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	statuses := []int{http.StatusInternalServerError, http.StatusOK, http.StatusOK, http.StatusBadGateway}
+	var i int
+	h := NewMiddleware(zap.New(core), WithErrorRateWindow(time.Minute, 6))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[i])
+		i++
+	}))
+	for range statuses {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	want := []float64{100, 50, 100.0 / 3, 50}
+	entries := logs.All()
+	if len(entries) != len(want) {
+		t.Fatalf("%d lines were logged, want %d", len(entries), len(want))
+	}
+	for i, e := range entries {
+		got, ok := e.ContextMap()["errorRatePct"].(float64)
+		if !ok || math.Abs(got-want[i]) > 0.01 {
+			t.Errorf("request %d: errorRatePct = %v, want %.2f", i, e.ContextMap()["errorRatePct"], want[i])
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package zaphttplog
+
+import (
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// mapFieldNames wraps m so that the names of the fields it adds directly are
+// renamed with mapper, or dropped if mapper returns an empty name. Fields of
+// nested objects, like header names, are left as-is.
+func mapFieldNames(m zapcore.ObjectMarshaler, mapper func(string) string) zapcore.ObjectMarshaler {
+	if mapper == nil {
+		return m
+	}
+	return zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+		return m.MarshalLogObject(fieldNameEncoder{enc: enc, mapper: mapper})
+	})
+}
+
+// fieldNameEncoder is a zapcore.ObjectEncoder that renames fields before passing
+// them on to another encoder, dropping those renamed to an empty name.
+type fieldNameEncoder struct {
+	enc    zapcore.ObjectEncoder
+	mapper func(string) string
+}
+
+func (f fieldNameEncoder) AddArray(key string, marshaler zapcore.ArrayMarshaler) error {
+	if key = f.mapper(key); key == "" {
+		return nil
+	}
+	return f.enc.AddArray(key, marshaler)
+}
+
+func (f fieldNameEncoder) AddObject(key string, marshaler zapcore.ObjectMarshaler) error {
+	if key = f.mapper(key); key == "" {
+		return nil
+	}
+	return f.enc.AddObject(key, marshaler)
+}
+
+func (f fieldNameEncoder) AddBinary(key string, value []byte) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddBinary(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddByteString(key string, value []byte) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddByteString(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddBool(key string, value bool) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddBool(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddComplex128(key string, value complex128) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddComplex128(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddComplex64(key string, value complex64) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddComplex64(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddDuration(key string, value time.Duration) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddDuration(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddFloat64(key string, value float64) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddFloat64(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddFloat32(key string, value float32) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddFloat32(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddInt(key string, value int) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddInt(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddInt64(key string, value int64) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddInt64(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddInt32(key string, value int32) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddInt32(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddInt16(key string, value int16) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddInt16(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddInt8(key string, value int8) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddInt8(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddString(key, value string) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddString(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddTime(key string, value time.Time) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddTime(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddUint(key string, value uint) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddUint(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddUint64(key string, value uint64) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddUint64(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddUint32(key string, value uint32) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddUint32(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddUint16(key string, value uint16) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddUint16(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddUint8(key string, value uint8) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddUint8(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddUintptr(key string, value uintptr) {
+	if key = f.mapper(key); key != "" {
+		f.enc.AddUintptr(key, value)
+	}
+}
+
+func (f fieldNameEncoder) AddReflected(key string, value interface{}) error {
+	if key = f.mapper(key); key == "" {
+		return nil
+	}
+	return f.enc.AddReflected(key, value)
+}
+
+func (f fieldNameEncoder) OpenNamespace(key string) {
+	// Fields added after a namespace is opened belong to it, so it can't be
+	// dropped.
+	if mapped := f.mapper(key); mapped != "" {
+		key = mapped
+	}
+	f.enc.OpenNamespace(key)
+}
@@ -0,0 +1,59 @@
+package zaphttplog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestMapFieldNames(t *testing.T) {
+	m := toMarshaler([]objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddInt("status", 200); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddDuration("elapsed", time.Second); return nil },
+		func(enc zapcore.ObjectEncoder) error {
+			return enc.AddObject("header", zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+				enc.AddString("content-type", "text/plain")
+				return nil
+			}))
+		},
+	})
+
+	enc := zapcore.NewMapObjectEncoder()
+	if err := mapFieldNames(m, func(name string) string { return "svc_" + name }).MarshalLogObject(enc); err != nil {
+		t.Fatalf("MarshalLogObject: %v", err)
+	}
+
+	want := map[string]interface{}{
+		"svc_status":  200,
+		"svc_elapsed": time.Second,
+		"svc_header":  map[string]interface{}{"content-type": "text/plain"},
+	}
+	if !reflect.DeepEqual(enc.Fields, want) {
+		t.Errorf("mapped fields = %+v, want %+v", enc.Fields, want)
+	}
+}
+
+func TestMiddlewareFieldPrefix(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithFieldPrefix("svc"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	httpResp := loggedObject(t, logs, "httpResponse")
+	if got := httpResp["svc_status"]; got != 200 {
+		t.Errorf("httpResponse[%q] = %v, want 200", "svc_status", got)
+	}
+	if _, ok := httpResp["status"]; ok {
+		t.Errorf("httpResponse has an unprefixed %q field", "status")
+	}
+	if got := loggedObject(t, logs, "httpRequest")["svc_requestMethod"]; got != http.MethodGet {
+		t.Errorf("httpRequest[%q] = %v, want %q", "svc_requestMethod", got, http.MethodGet)
+	}
+}
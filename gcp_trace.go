@@ -0,0 +1,48 @@
+package zaphttplog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// CloudTraceContextHeader is the header Google Cloud load balancers and Cloud
+// Run use to propagate trace context, formatted as
+// "TRACE_ID/SPAN_ID;o=TRACE_TRUE".
+const CloudTraceContextHeader = "X-Cloud-Trace-Context"
+
+// gcpTraceFields returns the fields Cloud Logging uses to correlate log entries
+// with Cloud Trace, for the given X-Cloud-Trace-Context header value. It returns
+// nil if the header can't be parsed.
+func gcpTraceFields(header, projectID string) []zap.Field {
+	traceID, spanID, ok := parseCloudTraceContext(header)
+	if !ok {
+		return nil
+	}
+	fields := []zap.Field{zap.String("logging.googleapis.com/trace", fmt.Sprintf("projects/%s/traces/%s", projectID, traceID))}
+	if spanID != "" {
+		fields = append(fields, zap.String("logging.googleapis.com/spanId", spanID))
+	}
+	return fields
+}
+
+// parseCloudTraceContext parses an X-Cloud-Trace-Context header value. The span
+// ID, which is decimal in the header, is returned as 16 hex digits, as Cloud
+// Logging expects, or empty if the header doesn't have one.
+func parseCloudTraceContext(header string) (traceID, spanID string, ok bool) {
+	header, _, _ = strings.Cut(header, ";")
+	traceID, span, hasSpan := strings.Cut(header, "/")
+	if len(traceID) != 32 || strings.Trim(traceID, "0123456789abcdefABCDEF") != "" {
+		return "", "", false
+	}
+	if !hasSpan || span == "" {
+		return traceID, "", true
+	}
+	id, err := strconv.ParseUint(span, 10, 64)
+	if err != nil {
+		return "", "", false
+	}
+	return traceID, fmt.Sprintf("%016x", id), true
+}
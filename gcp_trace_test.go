@@ -0,0 +1,60 @@
+package zaphttplog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestParseCloudTraceContext(t *testing.T) {
+	tests := []struct {
+		in                  string
+		wantTrace, wantSpan string
+		wantOK              bool
+	}{
+		{in: "105445aa7843bc8bf206b12000100000/1;o=1", wantTrace: "105445aa7843bc8bf206b12000100000", wantSpan: "0000000000000001", wantOK: true},
+		{in: "105445aa7843bc8bf206b12000100000/18446744073709551615", wantTrace: "105445aa7843bc8bf206b12000100000", wantSpan: "ffffffffffffffff", wantOK: true},
+		{in: "105445aa7843bc8bf206b12000100000", wantTrace: "105445aa7843bc8bf206b12000100000", wantOK: true},
+		{in: "105445aa7843bc8bf206b12000100000/abc;o=1"},
+		{in: "not-a-trace-id/1;o=1"},
+		{in: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			traceID, spanID, ok := parseCloudTraceContext(test.in)
+			if ok != test.wantOK {
+				t.Fatalf("got ok = %t, want %t", ok, test.wantOK)
+			}
+			if traceID != test.wantTrace || spanID != test.wantSpan {
+				t.Errorf("got trace, span = %q, %q, want %q, %q", traceID, spanID, test.wantTrace, test.wantSpan)
+			}
+		})
+	}
+}
+
+func TestMiddlewareGCPTraceContext(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithGCPTraceContext("my-project"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(CloudTraceContextHeader, "105445aa7843bc8bf206b12000100000/1;o=1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if logs.Len() != 1 {
+		t.Fatalf("%d lines were logged, want 1", logs.Len())
+	}
+	fields := logs.All()[0].ContextMap()
+	want := map[string]string{
+		"logging.googleapis.com/trace":  "projects/my-project/traces/105445aa7843bc8bf206b12000100000",
+		"logging.googleapis.com/spanId": "0000000000000001",
+	}
+	for k, v := range want {
+		if got := fields[k]; got != v {
+			t.Errorf("%s = %v, want %q", k, got, v)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package zaphttplog
+
+import (
+	"net"
+	"net/http"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// GeolocationDB looks up the approximate location of IP addresses, e.g. using
+// a MaxMind GeoLite2 database or an IP geolocation API.
+type GeolocationDB interface {
+	// LookupCountry returns the ISO 3166-1 alpha-2 code of the country the IP
+	// address is located in.
+	LookupCountry(ip string) (countryCode string, err error)
+}
+
+// countryCodeField returns the "countryCode" field for the client of the
+// request, or nil if it couldn't be looked up.
+func countryCodeField(r *http.Request, db GeolocationDB) objEncoderFn {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	code, err := db.LookupCountry(ip)
+	if err != nil || code == "" {
+		return nil
+	}
+	return func(enc zapcore.ObjectEncoder) error { enc.AddString("countryCode", code); return nil }
+}
@@ -0,0 +1,49 @@
+package zaphttplog
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// fakeGeolocationDB maps IP addresses to country codes.
+type fakeGeolocationDB map[string]string
+
+func (f fakeGeolocationDB) LookupCountry(ip string) (string, error) {
+	code, ok := f[ip]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return code, nil
+}
+
+func TestMiddlewareGeolocation(t *testing.T) {
+	db := fakeGeolocationDB{"203.0.113.7": "NZ"}
+	tests := []struct {
+		desc       string
+		remoteAddr string
+		want       interface{}
+	}{
+		{desc: "found", remoteAddr: "203.0.113.7:4321", want: "NZ"},
+		{desc: "lookup error", remoteAddr: "198.51.100.1:4321"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithGeolocation(db))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = test.remoteAddr
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got := loggedObject(t, logs, "httpRequest")["countryCode"]; got != test.want {
+				t.Errorf("httpRequest[%q] = %v, want %v", "countryCode", got, test.want)
+			}
+		})
+	}
+}
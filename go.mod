@@ -3,7 +3,12 @@ module github.com/Silicon-Ally/zaphttplog
 go 1.20
 
 require (
+	github.com/HdrHistogram/hdrhistogram-go v1.1.2
 	github.com/go-chi/chi/v5 v5.0.10
+	github.com/gorilla/mux v1.8.0
+	github.com/julienschmidt/httprouter v1.3.0
+	github.com/klauspost/compress v1.17.0
+	go.opentelemetry.io/otel v1.19.0
 	go.uber.org/zap v1.24.0
 )
 
@@ -0,0 +1,16 @@
+// Package gorillamux adapts zaphttplog to gorilla/mux routers, in its own
+// package so that zaphttplog doesn't depend on gorilla/mux.
+package gorillamux
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// ParamExtractor is a path parameter extractor for use with
+// zaphttplog.WithPathParamExtractor, which returns the route variables matched
+// by a gorilla/mux router.
+func ParamExtractor(r *http.Request) map[string]string {
+	return mux.Vars(r)
+}
@@ -0,0 +1,34 @@
+package gorillamux
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/Silicon-Ally/zaphttplog"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestParamExtractor(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	router := mux.NewRouter()
+	router.Use(mux.MiddlewareFunc(zaphttplog.NewMiddleware(zap.New(core),
+		zaphttplog.WithPathParamExtractor(ParamExtractor),
+		zaphttplog.WithURLParamRedactor(func(key, _ string) bool { return key == "token" }),
+	)))
+	router.HandleFunc("/users/{userID}/tokens/{token}", func(w http.ResponseWriter, r *http.Request) {})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/123/tokens/secret", nil))
+
+	if logs.Len() != 1 {
+		t.Fatalf("%d lines were logged, want 1", logs.Len())
+	}
+	httpReq, _ := logs.All()[0].ContextMap()["httpRequest"].(map[string]interface{})
+	want := map[string]interface{}{"userID": "123", "token": "***"}
+	if got := httpReq["pathParams"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("httpRequest[%q] = %v, want %v", "pathParams", got, want)
+	}
+}
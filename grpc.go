@@ -0,0 +1,197 @@
+package zaphttplog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// grpcCodeNames maps gRPC status codes to their names, matching the String()
+// output of google.golang.org/grpc/codes.Code. They're duplicated here to avoid
+// depending on the gRPC module; the codes are fixed by the gRPC spec.
+var grpcCodeNames = [...]string{
+	0:  "OK",
+	1:  "Canceled",
+	2:  "Unknown",
+	3:  "InvalidArgument",
+	4:  "DeadlineExceeded",
+	5:  "NotFound",
+	6:  "AlreadyExists",
+	7:  "PermissionDenied",
+	8:  "ResourceExhausted",
+	9:  "FailedPrecondition",
+	10: "Aborted",
+	11: "OutOfRange",
+	12: "Unimplemented",
+	13: "Internal",
+	14: "Unavailable",
+	15: "DataLoss",
+	16: "Unauthenticated",
+}
+
+// grpcCodeName returns the name of the given gRPC status code, formatted like
+// codes.Code.String() for unknown codes.
+func grpcCodeName(code int) string {
+	if code >= 0 && code < len(grpcCodeNames) {
+		return grpcCodeNames[code]
+	}
+	return "Code(" + strconv.Itoa(code) + ")"
+}
+
+// grpcStatusFields returns the "grpcStatus" and "grpcMessage" fields from the
+// grpc-status and grpc-message response trailers, if present. In trailers-only
+// responses, these are sent as regular headers instead.
+func grpcStatusFields(header http.Header) []objEncoderFn {
+	rawStatus := headerOrTrailer(header, "Grpc-Status")
+	if rawStatus == "" {
+		return nil
+	}
+
+	status := rawStatus
+	if code, err := strconv.Atoi(rawStatus); err == nil {
+		status = grpcCodeName(code)
+	}
+	out := []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("grpcStatus", status); return nil },
+	}
+
+	if msg := headerOrTrailer(header, "Grpc-Message"); msg != "" {
+		// grpc-message is percent-encoded, see
+		// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+		if decoded, err := url.PathUnescape(msg); err == nil {
+			msg = decoded
+		}
+		out = append(out, func(enc zapcore.ObjectEncoder) error { enc.AddString("grpcMessage", msg); return nil })
+	}
+	return out
+}
+
+// headerOrTrailer returns the value of the given key in a response header map
+// after the handler has returned, which includes trailers either under their
+// own key (if declared in the Trailer header) or with the http.TrailerPrefix.
+func headerOrTrailer(header http.Header, key string) string {
+	if v := header.Get(key); v != "" {
+		return v
+	}
+	return header.Get(http.TrailerPrefix + key)
+}
+
+// trailerFields returns a field logging the values of the given response
+// trailers as the "trailers" object, keyed by their lowercase names, or nil if
+// none of them were sent.
+func trailerFields(header http.Header, keys []string) objEncoderFn {
+	var names, values []string
+	for _, k := range keys {
+		if v := headerOrTrailer(header, k); v != "" {
+			names = append(names, strings.ToLower(k))
+			values = append(values, v)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return func(enc zapcore.ObjectEncoder) error {
+		return enc.AddObject("trailers", zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+			for i, name := range names {
+				enc.AddString(name, values[i])
+			}
+			return nil
+		}))
+	}
+}
+
+// maxGRPCWebTrailerSize bounds how much of a gRPC-Web trailer frame is kept.
+const maxGRPCWebTrailerSize = 4096
+
+// isGRPCWeb reports whether the content type is that of binary gRPC-Web, e.g.
+// application/grpc-web or application/grpc-web+proto. The base64-encoded
+// application/grpc-web-text isn't supported.
+func isGRPCWeb(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/grpc-web") &&
+		!strings.HasPrefix(contentType, "application/grpc-web-text")
+}
+
+// grpcWebTrailerReader is tee'd the body of a gRPC-Web response to find its
+// trailer frame. gRPC-Web sends trailers in the body rather than as HTTP
+// trailers, as a frame like any other but with the most significant bit of its
+// flags byte set, containing HTTP/1 style header lines. See
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-WEB.md
+type grpcWebTrailerReader struct {
+	// prefix is the flags byte and big-endian length of the current frame, of
+	// which prefixN bytes have been read.
+	prefix  [5]byte
+	prefixN int
+	// remaining is the number of bytes left in the current frame.
+	remaining uint32
+	// inTrailer is set while reading a trailer frame into trailer.
+	inTrailer bool
+	trailer   []byte
+	// found is set once a trailer frame was read.
+	found bool
+}
+
+func (g *grpcWebTrailerReader) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if g.prefixN < len(g.prefix) {
+			c := copy(g.prefix[g.prefixN:], p)
+			g.prefixN += c
+			p = p[c:]
+			if g.prefixN < len(g.prefix) {
+				break
+			}
+			g.remaining = binary.BigEndian.Uint32(g.prefix[1:])
+			g.inTrailer = g.prefix[0]&0x80 != 0
+			if g.inTrailer {
+				g.trailer = g.trailer[:0]
+				g.found = true
+			}
+			if g.remaining == 0 {
+				g.prefixN = 0
+			}
+			continue
+		}
+
+		chunk := p
+		if uint32(len(chunk)) > g.remaining {
+			chunk = chunk[:g.remaining]
+		}
+		if g.inTrailer {
+			if room := maxGRPCWebTrailerSize - len(g.trailer); room > 0 {
+				if len(chunk) < room {
+					room = len(chunk)
+				}
+				g.trailer = append(g.trailer, chunk[:room]...)
+			}
+		}
+		g.remaining -= uint32(len(chunk))
+		p = p[len(chunk):]
+		if g.remaining == 0 {
+			g.prefixN = 0
+		}
+	}
+	// The body is written to the client regardless, so errors aren't reported.
+	return n, nil
+}
+
+// header returns the trailers read from the trailer frame, and whether one was
+// found.
+func (g *grpcWebTrailerReader) header() (http.Header, bool) {
+	if !g.found {
+		return nil, false
+	}
+	header := make(http.Header)
+	for _, line := range bytes.Split(g.trailer, []byte("\r\n")) {
+		k, v, ok := bytes.Cut(line, []byte(":"))
+		if !ok {
+			continue
+		}
+		header.Add(string(bytes.TrimSpace(k)), string(bytes.TrimSpace(v)))
+	}
+	return header, true
+}
@@ -0,0 +1,187 @@
+package zaphttplog
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestGRPCCodeName(t *testing.T) {
+	tests := []struct {
+		code int
+		want string
+	}{
+		{
+			code: 0,
+			want: "OK",
+		},
+		{
+			code: 5,
+			want: "NotFound",
+		},
+		{
+			code: 16,
+			want: "Unauthenticated",
+		},
+		{
+			code: 17,
+			want: "Code(17)",
+		},
+		{
+			code: -1,
+			want: "Code(-1)",
+		},
+	}
+
+	for _, test := range tests {
+		got := grpcCodeName(test.code)
+		if got != test.want {
+			t.Errorf("grpcCodeName(%d) = %q, want %q", test.code, got, test.want)
+		}
+	}
+}
+
+func TestMiddlewareGRPCStatusLogging(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithGRPCStatusLogging(true))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write([]byte("ok"))
+		w.Header().Set("Grpc-Status", "5")
+		w.Header().Set("Grpc-Message", "user not found")
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/users.Users/Get", nil))
+
+	httpResp := loggedObject(t, logs, "httpResponse")
+	if got := httpResp["grpcStatus"]; got != "NotFound" {
+		t.Errorf("httpResponse[%q] = %v, want %q", "grpcStatus", got, "NotFound")
+	}
+	if got := httpResp["grpcMessage"]; got != "user not found" {
+		t.Errorf("httpResponse[%q] = %v, want %q", "grpcMessage", got, "user not found")
+	}
+}
+
+func TestHeaderOrTrailer(t *testing.T) {
+	tests := []struct {
+		desc   string
+		header http.Header
+		want   string
+	}{
+		{
+			desc:   "declared trailer",
+			header: http.Header{"Grpc-Status": {"3"}},
+			want:   "3",
+		},
+		{
+			desc:   "prefixed trailer",
+			header: http.Header{http.TrailerPrefix + "Grpc-Status": {"4"}},
+			want:   "4",
+		},
+		{
+			desc:   "missing",
+			header: http.Header{"Content-Type": {"application/grpc"}},
+			want:   "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got := headerOrTrailer(test.header, "Grpc-Status")
+			if got != test.want {
+				t.Errorf("headerOrTrailer(%v) = %q, want %q", test.header, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareTrailerFields(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	mw := NewMiddleware(zap.New(core), WithDeclareTrailerKeys([]string{"Server-Timing"}), WithGRPCTrailerFields([]string{"Server-Timing", "Grpc-Status"}))
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := w.Header().Get("Trailer"), "Server-Timing"; got != want {
+			t.Errorf("Trailer header = %q, want %q", got, want)
+		}
+		w.Write([]byte("ok"))
+		w.Header().Set("Server-Timing", "db;dur=53")
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	want := map[string]interface{}{"server-timing": "db;dur=53"}
+	if got := loggedObject(t, logs, "httpResponse")["trailers"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("httpResponse[%q] = %v, want %v", "trailers", got, want)
+	}
+}
+
+// grpcWebFrame returns a gRPC-Web frame with the given flags and payload.
+func grpcWebFrame(flags byte, payload string) []byte {
+	frame := []byte{flags, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func TestMiddlewareGRPCWebLogging(t *testing.T) {
+	body := append(grpcWebFrame(0, "message"), grpcWebFrame(0x80, "grpc-status: 5\r\ngrpc-message: no%20such%20user\r\n")...)
+
+	tests := []struct {
+		desc        string
+		contentType string
+		// chunkSize is the size of each write of the body, to check frames
+		// split across writes are decoded.
+		chunkSize   int
+		wantStatus  interface{}
+		wantMessage interface{}
+	}{
+		{
+			desc:        "single write",
+			contentType: "application/grpc-web+proto",
+			chunkSize:   len(body),
+			wantStatus:  "NotFound",
+			wantMessage: "no such user",
+		},
+		{
+			desc:        "split writes",
+			contentType: "application/grpc-web",
+			chunkSize:   3,
+			wantStatus:  "NotFound",
+			wantMessage: "no such user",
+		},
+		{
+			desc:        "not gRPC-Web",
+			contentType: "application/json",
+			chunkSize:   len(body),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithGRPCWebLogging(true))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for b := body; len(b) > 0; {
+					n := test.chunkSize
+					if n > len(b) {
+						n = len(b)
+					}
+					w.Write(b[:n])
+					b = b[n:]
+				}
+			}))
+			req := httptest.NewRequest(http.MethodPost, "/pkg.Users/Get", nil)
+			req.Header.Set("Content-Type", test.contentType)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			httpResp := loggedObject(t, logs, "httpResponse")
+			if got := httpResp["grpcStatus"]; got != test.wantStatus {
+				t.Errorf("httpResponse[%q] = %v, want %v", "grpcStatus", got, test.wantStatus)
+			}
+			if got := httpResp["grpcMessage"]; got != test.wantMessage {
+				t.Errorf("httpResponse[%q] = %v, want %v", "grpcMessage", got, test.wantMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+// Package httprouter adapts zaphttplog to julienschmidt/httprouter routers, in
+// its own package so that zaphttplog doesn't depend on httprouter.
+package httprouter
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// ParamExtractor is a path parameter extractor for use with
+// zaphttplog.WithPathParamExtractor, which returns the parameters matched by an
+// httprouter router.
+func ParamExtractor(r *http.Request) map[string]string {
+	params := httprouter.ParamsFromContext(r.Context())
+	if len(params) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(params))
+	for _, p := range params {
+		out[p.Key] = p.Value
+	}
+	return out
+}
@@ -0,0 +1,162 @@
+package zaphttplog
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap/zapcore"
+)
+
+// LatencyTracker records request latencies and reports their percentiles, for
+// use with WithLatencyPercentileTracker.
+type LatencyTracker interface {
+	// RecordAndQuery records the latency of a request to the endpoint with the
+	// given method and path, which is the chi route pattern of the request, or
+	// UnmatchedLatencyPath if it didn't match one, and returns the endpoint's
+	// latency percentiles.
+	RecordAndQuery(method, path string, elapsed time.Duration) (p50, p95, p99 time.Duration)
+}
+
+const (
+	// latencyWindows is the number of sub-windows the latency histograms of
+	// hdrLatencyTracker are split into. The oldest one is dropped every
+	// latencyWindowInterval, so percentiles cover the last minute or so.
+	latencyWindows        = 6
+	latencyWindowInterval = 10 * time.Second
+
+	// maxLatencyEndpoints is the number of endpoints hdrLatencyTracker keeps
+	// histograms for. Past that, the least recently requested one is dropped.
+	maxLatencyEndpoints = 1000
+)
+
+// UnmatchedLatencyPath is the path the latencies of requests that didn't match
+// a chi route are recorded under, so that requests for arbitrary paths don't
+// each get an endpoint of their own.
+const UnmatchedLatencyPath = "unmatched"
+
+// latencyPath returns the path the latency of r is recorded under.
+func latencyPath(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			return pattern
+		}
+	}
+	return UnmatchedLatencyPath
+}
+
+// NewHDRLatencyTracker returns a LatencyTracker that keeps an HDR histogram of
+// the latencies of each endpoint over a sliding window of about a minute.
+// Only the 1000 most recently requested endpoints are tracked. Latencies are
+// recorded with microsecond resolution, up to maxVal, with the given number of
+// significant figures, between 1 and 5. Larger latencies are recorded as
+// maxVal. It panics if maxVal is less than a microsecond or sigFigs is out of
+// range.
+func NewHDRLatencyTracker(maxVal time.Duration, sigFigs int) LatencyTracker {
+	if maxVal < time.Microsecond {
+		panic(fmt.Sprintf("zaphttplog: NewHDRLatencyTracker maxVal %v is less than a microsecond", maxVal))
+	}
+	if sigFigs < 1 || sigFigs > 5 {
+		panic(fmt.Sprintf("zaphttplog: NewHDRLatencyTracker sigFigs %d is not between 1 and 5", sigFigs))
+	}
+	return &hdrLatencyTracker{
+		max:       maxVal.Microseconds(),
+		sigFigs:   sigFigs,
+		endpoints: make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+type hdrLatencyTracker struct {
+	max     int64
+	sigFigs int
+
+	mu sync.Mutex
+	// endpoints maps endpoint keys to their elements in lru, the values of
+	// which are *endpointLatencies, most recently requested first.
+	endpoints map[string]*list.Element
+	lru       *list.List
+}
+
+type endpointLatencies struct {
+	key  string
+	hist *hdrhistogram.WindowedHistogram
+	// snapshot is hist merged as of its last rotation, with every value
+	// recorded since added, so percentiles can be read from it without
+	// merging the sub-windows on every request.
+	snapshot *hdrhistogram.Histogram
+	// rotated is when hist was last rotated.
+	rotated time.Time
+}
+
+func (h *hdrLatencyTracker) RecordAndQuery(method, path string, elapsed time.Duration) (p50, p95, p99 time.Duration) {
+	now := time.Now()
+	key := method + " " + path
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e := h.endpoint(key, now)
+	if now.Sub(e.rotated) >= latencyWindowInterval {
+		for i := 0; i < latencyWindows && now.Sub(e.rotated) >= latencyWindowInterval; i++ {
+			e.hist.Rotate()
+			e.rotated = e.rotated.Add(latencyWindowInterval)
+		}
+		if now.Sub(e.rotated) >= latencyWindowInterval {
+			// All sub-windows were rotated out.
+			e.rotated = now
+		}
+		e.snapshot = e.hist.Merge()
+	}
+
+	v := elapsed.Microseconds()
+	if v > h.max {
+		v = h.max
+	}
+	if v < 1 {
+		v = 1
+	}
+	e.hist.Current.RecordValue(v)
+	e.snapshot.RecordValue(v)
+
+	return time.Duration(e.snapshot.ValueAtQuantile(50)) * time.Microsecond,
+		time.Duration(e.snapshot.ValueAtQuantile(95)) * time.Microsecond,
+		time.Duration(e.snapshot.ValueAtQuantile(99)) * time.Microsecond
+}
+
+// endpoint returns the latencies of the endpoint with the given key, creating
+// them, and dropping those of the least recently requested endpoint if there
+// are too many, if there are none. h.mu must be held.
+func (h *hdrLatencyTracker) endpoint(key string, now time.Time) *endpointLatencies {
+	if elem, ok := h.endpoints[key]; ok {
+		h.lru.MoveToFront(elem)
+		return elem.Value.(*endpointLatencies)
+	}
+	if h.lru.Len() >= maxLatencyEndpoints {
+		oldest := h.lru.Back()
+		h.lru.Remove(oldest)
+		delete(h.endpoints, oldest.Value.(*endpointLatencies).key)
+	}
+	e := &endpointLatencies{
+		key:      key,
+		hist:     hdrhistogram.NewWindowed(latencyWindows, 1, h.max, h.sigFigs),
+		snapshot: hdrhistogram.New(1, h.max, h.sigFigs),
+		rotated:  now,
+	}
+	h.endpoints[key] = h.lru.PushFront(e)
+	return e
+}
+
+// latencyPercentileFields returns the "p50ms", "p95ms" and "p99ms" fields.
+func latencyPercentileFields(p50, p95, p99 time.Duration) []objEncoderFn {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddFloat64("p50ms", ms(p50)); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddFloat64("p95ms", ms(p95)); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddFloat64("p99ms", ms(p99)); return nil },
+	}
+}
@@ -0,0 +1,145 @@
+package zaphttplog
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestHDRLatencyTracker(t *testing.T) {
+	tracker := NewHDRLatencyTracker(10*time.Second, 3)
+
+	var p50, p95, p99 time.Duration
+	for i := 1; i <= 100; i++ {
+		p50, p95, p99 = tracker.RecordAndQuery(http.MethodGet, "/users", time.Duration(i)*time.Millisecond)
+	}
+	checks := []struct {
+		name string
+		got  time.Duration
+		want time.Duration
+	}{
+		{"p50", p50, 50 * time.Millisecond},
+		{"p95", p95, 95 * time.Millisecond},
+		{"p99", p99, 99 * time.Millisecond},
+	}
+	for _, c := range checks {
+		// Three significant figures give 0.1% precision.
+		if diff := math.Abs(float64(c.got - c.want)); diff > float64(c.want)/1000 {
+			t.Errorf("%s = %v, want about %v", c.name, c.got, c.want)
+		}
+	}
+
+	// Endpoints are tracked separately.
+	if p50, _, _ := tracker.RecordAndQuery(http.MethodPost, "/users", time.Second); p50 < 999*time.Millisecond {
+		t.Errorf("p50 of a new endpoint = %v, want about %v", p50, time.Second)
+	}
+}
+
+func TestNewHDRLatencyTrackerValidatesArgs(t *testing.T) {
+	tests := []struct {
+		desc      string
+		maxVal    time.Duration
+		sigFigs   int
+		wantPanic bool
+	}{
+		{desc: "valid", maxVal: time.Second, sigFigs: 3},
+		{desc: "smallest", maxVal: time.Microsecond, sigFigs: 1},
+		{desc: "largest sigFigs", maxVal: time.Second, sigFigs: 5},
+		{desc: "zero maxVal", maxVal: 0, sigFigs: 3, wantPanic: true},
+		{desc: "sub-microsecond maxVal", maxVal: time.Nanosecond, sigFigs: 3, wantPanic: true},
+		{desc: "zero sigFigs", maxVal: time.Second, sigFigs: 0, wantPanic: true},
+		{desc: "too many sigFigs", maxVal: time.Second, sigFigs: 6, wantPanic: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			defer func() {
+				if r := recover(); (r != nil) != test.wantPanic {
+					t.Errorf("NewHDRLatencyTracker(%v, %d) panic = %v, want panic %t", test.maxVal, test.sigFigs, r, test.wantPanic)
+				}
+			}()
+			tracker := NewHDRLatencyTracker(test.maxVal, test.sigFigs)
+			tracker.RecordAndQuery(http.MethodGet, "/", time.Millisecond)
+		})
+	}
+}
+
+func TestMiddlewareLatencyPercentileTracker(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithLatencyPercentileTracker(NewHDRLatencyTracker(time.Second, 2)))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	httpResp := loggedObject(t, logs, "httpResponse")
+	for _, k := range []string{"p50ms", "p95ms", "p99ms"} {
+		if _, ok := httpResp[k].(float64); !ok {
+			t.Errorf("httpResponse[%q] = %v (%T), want a float64", k, httpResp[k], httpResp[k])
+		}
+	}
+}
+
+func TestHDRLatencyTrackerEvictsLeastRecentEndpoint(t *testing.T) {
+	tracker := NewHDRLatencyTracker(10*time.Second, 2).(*hdrLatencyTracker)
+
+	tracker.RecordAndQuery(http.MethodGet, "/first", time.Second)
+	for i := 1; i < maxLatencyEndpoints; i++ {
+		tracker.RecordAndQuery(http.MethodGet, fmt.Sprintf("/%d", i), time.Millisecond)
+	}
+	// Requesting /first again makes /1 the least recently requested endpoint.
+	tracker.RecordAndQuery(http.MethodGet, "/first", time.Second)
+	tracker.RecordAndQuery(http.MethodGet, "/new", time.Millisecond)
+
+	if n := len(tracker.endpoints); n != maxLatencyEndpoints {
+		t.Errorf("tracked %d endpoints, want %d", n, maxLatencyEndpoints)
+	}
+	if _, ok := tracker.endpoints["GET /1"]; ok {
+		t.Error("least recently requested endpoint wasn't dropped")
+	}
+	if p50, _, _ := tracker.RecordAndQuery(http.MethodGet, "/first", time.Second); p50 < 990*time.Millisecond {
+		t.Errorf("p50 of a recently requested endpoint = %v, want about %v", p50, time.Second)
+	}
+}
+
+func TestHDRLatencyTrackerRotation(t *testing.T) {
+	tracker := NewHDRLatencyTracker(10*time.Second, 2).(*hdrLatencyTracker)
+	tracker.RecordAndQuery(http.MethodGet, "/", time.Second)
+
+	// Age the endpoint past the whole window; the old latency must not count.
+	tracker.endpoints["GET /"].Value.(*endpointLatencies).rotated = time.Now().Add(-latencyWindows * latencyWindowInterval)
+	if _, _, p99 := tracker.RecordAndQuery(http.MethodGet, "/", time.Millisecond); p99 > 2*time.Millisecond {
+		t.Errorf("p99 after the window passed = %v, want about %v", p99, time.Millisecond)
+	}
+}
+
+func TestMiddlewareLatencyPercentileTrackerUnmatched(t *testing.T) {
+	var paths []string
+	tracker := latencyTrackerFunc(func(method, path string, elapsed time.Duration) (p50, p95, p99 time.Duration) {
+		paths = append(paths, path)
+		return 0, 0, 0
+	})
+	r := chi.NewRouter()
+	r.Use(NewMiddleware(zap.NewNop(), WithLatencyPercentileTracker(tracker)))
+	r.Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, path := range []string{"/users/1", "/no/such/path", "/another"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	want := []string{"/users/{id}", UnmatchedLatencyPath, UnmatchedLatencyPath}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("recorded paths = %q, want %q", paths, want)
+	}
+}
+
+type latencyTrackerFunc func(method, path string, elapsed time.Duration) (p50, p95, p99 time.Duration)
+
+func (f latencyTrackerFunc) RecordAndQuery(method, path string, elapsed time.Duration) (p50, p95, p99 time.Duration) {
+	return f(method, path, elapsed)
+}
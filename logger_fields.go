@@ -0,0 +1,50 @@
+package zaphttplog
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// TrackLoggerFields wraps logger so that the names of fields later added to it
+// with With are recorded, which lets WithElideDuplicateFields skip default
+// fields that the logger already has. Zap doesn't expose the fields on a
+// logger, so fields added before the logger was wrapped can't be seen.
+func TrackLoggerFields(logger *zap.Logger) *zap.Logger {
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &fieldNameCore{Core: core}
+	}))
+}
+
+// fieldNameCore is a zapcore.Core that records the names of the fields added to
+// it with With.
+type fieldNameCore struct {
+	zapcore.Core
+	names map[string]struct{}
+}
+
+func (c *fieldNameCore) With(fields []zapcore.Field) zapcore.Core {
+	names := make(map[string]struct{}, len(c.names)+len(fields))
+	for name := range c.names {
+		names[name] = struct{}{}
+	}
+	for _, f := range fields {
+		names[f.Key] = struct{}{}
+	}
+	return &fieldNameCore{Core: c.Core.With(fields), names: names}
+}
+
+// elideDuplicateFields returns the fields whose names aren't already on
+// logger. Loggers that weren't wrapped with TrackLoggerFields get all of them.
+func elideDuplicateFields(logger *zap.Logger, fields []zap.Field) []zap.Field {
+	core, ok := logger.Core().(*fieldNameCore)
+	if !ok || len(core.names) == 0 {
+		return fields
+	}
+	var out []zap.Field
+	for _, f := range fields {
+		if _, ok := core.names[f.Key]; !ok {
+			out = append(out, f)
+		}
+	}
+	return out
+}
@@ -0,0 +1,46 @@
+package zaphttplog
+
+import (
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestElideDuplicateFields(t *testing.T) {
+	defaults := []zap.Field{zap.String("service", "other"), zap.String("region", "us")}
+
+	tests := []struct {
+		desc   string
+		logger *zap.Logger
+		want   []string
+	}{
+		{
+			desc:   "untracked logger",
+			logger: zap.NewNop().With(zap.String("service", "api")),
+			want:   []string{"service", "region"},
+		},
+		{
+			desc:   "tracked logger",
+			logger: TrackLoggerFields(zap.NewNop()).With(zap.String("service", "api")),
+			want:   []string{"region"},
+		},
+		{
+			desc:   "tracked logger without fields",
+			logger: TrackLoggerFields(zap.NewNop()),
+			want:   []string{"service", "region"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			var got []string
+			for _, f := range elideDuplicateFields(test.logger, defaults) {
+				got = append(got, f.Key)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got fields = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package zaphttplog
+
+// OptionConflict is a combination of options that doesn't make sense, usually
+// because one of them has no effect. NewMiddlewareE returns the conflicts it
+// finds, which can be checked for with errors.Is, and NewMiddleware logs them
+// as a warning.
+type OptionConflict string
+
+func (c OptionConflict) Error() string {
+	return string(c)
+}
+
+const (
+	// ConflictConciseResponseBody is reported when response body options are
+	// set in Concise mode, which doesn't log response bodies.
+	ConflictConciseResponseBody OptionConflict = "response body options have no effect with Concise, which doesn't log response bodies"
+	// ConflictCaptureBodyAlwaysUnused is reported when CaptureBodyAlways is set
+	// without ResponseBodyHash or RequestMeter, the only uses of bodies that
+	// aren't logged.
+	ConflictCaptureBodyAlwaysUnused OptionConflict = "CaptureBodyAlways has no effect without ResponseBodyHash"
+	// ConflictVerboseHeaderWithoutSecret is reported when VerboseHeader is set
+	// without VerboseHeaderSecret, so verbose logging is never enabled.
+	ConflictVerboseHeaderWithoutSecret OptionConflict = "VerboseHeader has no effect without VerboseHeaderSecret"
+	// ConflictUnbufferedConcurrencyLimit is reported when ConcurrencyLimit is an
+	// unbuffered channel, which has no slots, so every request would block.
+	ConflictUnbufferedConcurrencyLimit OptionConflict = "ConcurrencyLimit must be a buffered channel"
+	// ConflictUnavailableHash is reported when WebhookSignatureHash or
+	// ResponseBodyHash is a hash function that isn't linked into the binary.
+	ConflictUnavailableHash OptionConflict = "hash function isn't linked into the binary"
+)
+
+// conflicts returns the conflicts between the options.
+func (o *Options) conflicts() []OptionConflict {
+	var out []OptionConflict
+	if o.Concise && (len(o.ResponseBodyConditions) > 0 || len(o.CaptureBodyCodes) > 0 || o.ResponseBodyHash != 0 || o.CaptureBodyAlways || o.BodyCaptureMaxAge > 0) {
+		out = append(out, ConflictConciseResponseBody)
+	}
+	if o.CaptureBodyAlways && o.ResponseBodyHash == 0 && o.RequestMeter == nil {
+		out = append(out, ConflictCaptureBodyAlwaysUnused)
+	}
+	if o.VerboseHeader != "" && o.VerboseHeaderSecret == "" {
+		out = append(out, ConflictVerboseHeaderWithoutSecret)
+	}
+	if o.ConcurrencyLimit != nil && cap(o.ConcurrencyLimit) == 0 {
+		out = append(out, ConflictUnbufferedConcurrencyLimit)
+	}
+	if (o.WebhookSignatureHeader != "" && !o.WebhookSignatureHash.Available()) || (o.ResponseBodyHash != 0 && !o.ResponseBodyHash.Available()) {
+		out = append(out, ConflictUnavailableHash)
+	}
+	return out
+}
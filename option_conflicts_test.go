@@ -0,0 +1,79 @@
+package zaphttplog
+
+import (
+	"crypto"
+	"errors"
+	"net/http"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestNewMiddlewareE(t *testing.T) {
+	tests := []struct {
+		desc    string
+		options []Option
+		want    []OptionConflict
+	}{
+		{
+			desc:    "no conflicts",
+			options: []Option{WithConcise(true), WithEnableVerboseHeader("X-Debug", "secret")},
+		},
+		{
+			desc:    "concise with body options",
+			options: []Option{WithConcise(true), WithResponseBodyHash(crypto.SHA256)},
+			want:    []OptionConflict{ConflictConciseResponseBody},
+		},
+		{
+			desc: "body captured for the request meter",
+			options: []Option{WithCaptureBodyAlways(true), WithRequestMeter(func(*http.Request, []byte) (int, int) {
+				return 0, 0
+			})},
+		},
+		{
+			desc:    "unused options",
+			options: []Option{WithCaptureBodyAlways(true), WithEnableVerboseHeader("X-Debug", ""), WithConcurrencyLimitChan(make(chan struct{}))},
+			want:    []OptionConflict{ConflictCaptureBodyAlwaysUnused, ConflictVerboseHeaderWithoutSecret, ConflictUnbufferedConcurrencyLimit},
+		},
+		{
+			desc:    "unavailable hash",
+			options: []Option{WithResponseBodyHash(crypto.BLAKE2b_256)},
+			want:    []OptionConflict{ConflictUnavailableHash},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			mw, err := NewMiddlewareE(zap.NewNop(), test.options...)
+			if len(test.want) == 0 {
+				if err != nil || mw == nil {
+					t.Fatalf("NewMiddlewareE() = %v, %v, want middleware and no error", mw, err)
+				}
+				return
+			}
+			if mw != nil {
+				t.Error("NewMiddlewareE() returned middleware along with an error")
+			}
+			for _, want := range test.want {
+				if !errors.Is(err, want) {
+					t.Errorf("NewMiddlewareE() error = %v, want %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewMiddlewareWarnsOfConflicts(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	NewMiddleware(zap.New(core), WithCaptureBodyAlways(true))
+
+	if logs.Len() != 1 || logs.All()[0].Level != zapcore.WarnLevel {
+		t.Fatalf("logged %+v, want a single warning", logs.All())
+	}
+	conflicts, _ := logs.All()[0].ContextMap()["conflicts"].([]interface{})
+	if len(conflicts) != 1 || conflicts[0] != string(ConflictCaptureBodyAlwaysUnused) {
+		t.Errorf("conflicts = %v, want [%q]", conflicts, ConflictCaptureBodyAlwaysUnused)
+	}
+}
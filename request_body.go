@@ -0,0 +1,138 @@
+package zaphttplog
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// readCloser combines a reader with the io.Closer of the original request body
+// it wraps, so closing it still closes the original body.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// countingReadCloser counts the bytes read from the request body it wraps.
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// peekRequestBody reads up to n bytes from the request body and returns them,
+// replacing the body so that the handler can still read it in full.
+func peekRequestBody(r *http.Request, n int) []byte {
+	body, _, _ := readRequestBody(r, int64(n))
+	return body
+}
+
+// defaultMaxRequestReadBytes is the maximum number of bytes of a request body
+// the middleware reads itself when no MaxRequestReadBytes is set.
+const defaultMaxRequestReadBytes = 1 << 20
+
+// readRequestBody reads up to limit bytes from the request body, or
+// defaultMaxRequestReadBytes if limit isn't positive, and replaces the body so
+// that the handler can still read it in full. truncated reports whether the
+// body was longer than that.
+func readRequestBody(r *http.Request, limit int64) (body []byte, truncated bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, false, nil
+	}
+	if limit <= 0 {
+		limit = defaultMaxRequestReadBytes
+	}
+	// Read an extra byte to tell whether there's more.
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	r.Body = readCloser{
+		Reader: io.MultiReader(bytes.NewReader(buf), r.Body),
+		Closer: r.Body,
+	}
+	if int64(len(buf)) > limit {
+		return buf[:limit], true, err
+	}
+	return buf, false, err
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// parseJSONRequestBody parses a JSON object from body and redacts the values of
+// the given fields, which may be dot-separated paths to nested fields, e.g.
+// "user.password". It returns false if body isn't a complete JSON object.
+func parseJSONRequestBody(body []byte, redactFields []string) (map[string]interface{}, bool) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(body, &obj); err != nil || obj == nil {
+		return nil, false
+	}
+	for _, field := range redactFields {
+		redactJSONPath(obj, strings.Split(field, "."))
+	}
+	return obj, true
+}
+
+// redactJSONPath redacts the value at the given path in v. Arrays along the path
+// have the rest of the path redacted in each of their elements.
+func redactJSONPath(v interface{}, path []string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		child, ok := v[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) == 1 {
+			v[path[0]] = "***"
+			return
+		}
+		redactJSONPath(child, path[1:])
+	case []interface{}:
+		for _, elem := range v {
+			redactJSONPath(elem, path)
+		}
+	}
+}
+
+// verifyBodySignature reads the request body to check it against the hex-encoded
+// HMAC signature in the given header, and replaces the body so it can still be
+// read by the handler. The signature may have a prefix like "sha256=". Bodies
+// longer than limit, or defaultMaxRequestReadBytes if limit isn't positive,
+// can't be verified, and are reported as truncated.
+func verifyBodySignature(r *http.Request, header string, algo crypto.Hash, key []byte, limit int64) (valid, truncated bool) {
+	if !algo.Available() || r.Body == nil {
+		return false, false
+	}
+
+	body, truncated, err := readRequestBody(r, limit)
+	if err != nil || truncated {
+		return false, truncated
+	}
+
+	sig := r.Header.Get(header)
+	if idx := strings.IndexByte(sig, '='); idx >= 0 {
+		sig = sig[idx+1:]
+	}
+	want, err := hex.DecodeString(sig)
+	if err != nil {
+		return false, false
+	}
+
+	mac := hmac.New(algo.New, key)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), want), false
+}
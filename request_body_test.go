@@ -0,0 +1,448 @@
+package zaphttplog
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestPeekRequestBody(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello world"))
+
+	if got, want := string(peekRequestBody(r, 5)), "hello"; got != want {
+		t.Errorf("peekRequestBody() = %q, want %q", got, want)
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if got, want := string(body), "hello world"; got != want {
+		t.Errorf("body after peekRequestBody() = %q, want %q", got, want)
+	}
+}
+
+func TestReadRequestBodyDefaultLimit(t *testing.T) {
+	payload := strings.Repeat("x", defaultMaxRequestReadBytes+10)
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(payload))
+
+	got, truncated, err := readRequestBody(r, 0)
+	if err != nil {
+		t.Fatalf("readRequestBody: %v", err)
+	}
+	if len(got) != defaultMaxRequestReadBytes || !truncated {
+		t.Errorf("readRequestBody() read %d bytes, truncated %t, want %d, true", len(got), truncated, defaultMaxRequestReadBytes)
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if len(body) != len(payload) {
+		t.Errorf("body after readRequestBody() has %d bytes, want %d", len(body), len(payload))
+	}
+}
+
+func TestParseJSONRequestBody(t *testing.T) {
+	tests := []struct {
+		desc   string
+		body   string
+		redact []string
+		want   map[string]interface{}
+		wantOK bool
+	}{
+		{
+			desc:   "top-level redaction",
+			body:   `{"user": "alice", "password": "hunter2"}`,
+			redact: []string{"password"},
+			want:   map[string]interface{}{"user": "alice", "password": "***"},
+			wantOK: true,
+		},
+		{
+			desc:   "nested redaction",
+			body:   `{"card": {"number": "4242", "brand": "visa"}, "items": [{"secret": 1}, {"secret": 2}]}`,
+			redact: []string{"card.number", "items.secret", "missing.field"},
+			want: map[string]interface{}{
+				"card":  map[string]interface{}{"number": "***", "brand": "visa"},
+				"items": []interface{}{map[string]interface{}{"secret": "***"}, map[string]interface{}{"secret": "***"}},
+			},
+			wantOK: true,
+		},
+		{
+			desc:   "truncated",
+			body:   `{"user": "ali`,
+			wantOK: false,
+		},
+		{
+			desc:   "not an object",
+			body:   `[1, 2, 3]`,
+			wantOK: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got, ok := parseJSONRequestBody([]byte(test.body), test.redact)
+			if ok != test.wantOK {
+				t.Fatalf("parseJSONRequestBody() ok = %t, want %t", ok, test.wantOK)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseJSONRequestBody() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyBodySignature(t *testing.T) {
+	key := []byte("secret")
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("payload"))
+	sig := hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		desc          string
+		sig           string
+		limit         int64
+		want          bool
+		wantTruncated bool
+	}{
+		{
+			desc: "valid",
+			sig:  sig,
+			want: true,
+		},
+		{
+			desc: "valid with prefix",
+			sig:  "sha256=" + sig,
+			want: true,
+		},
+		{
+			desc: "wrong signature",
+			sig:  "sha256=" + strings.Repeat("0", len(sig)),
+			want: false,
+		},
+		{
+			desc: "not hex",
+			sig:  "not-a-signature",
+			want: false,
+		},
+		{
+			desc: "missing",
+			sig:  "",
+			want: false,
+		},
+		{
+			desc:  "within limit",
+			sig:   sig,
+			limit: int64(len("payload")),
+			want:  true,
+		},
+		{
+			desc:          "over limit",
+			sig:           sig,
+			limit:         3,
+			want:          false,
+			wantTruncated: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload"))
+			r.Header.Set("X-Signature", test.sig)
+
+			got, truncated := verifyBodySignature(r, "X-Signature", crypto.SHA256, key, test.limit)
+			if got != test.want || truncated != test.wantTruncated {
+				t.Errorf("verifyBodySignature() = %t, %t, want %t, %t", got, truncated, test.want, test.wantTruncated)
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Fatalf("failed to read body: %v", err)
+			}
+			if string(body) != "payload" {
+				t.Errorf("body after verifyBodySignature() = %q, want %q", body, "payload")
+			}
+		})
+	}
+}
+
+func TestMiddlewareActualRequestBodySize(t *testing.T) {
+	tests := []struct {
+		desc         string
+		readN        int64
+		wantRead     int64
+		wantMismatch bool
+	}{
+		{desc: "read in full", readN: 100, wantRead: 11},
+		{desc: "read partially", readN: 5, wantRead: 5, wantMismatch: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithActualRequestBodySize(true))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, io.LimitReader(r.Body, test.readN))
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello world")))
+
+			httpReq := loggedObject(t, logs, "httpRequest")
+			if got := httpReq["requestBodyBytesRead"]; got != test.wantRead {
+				t.Errorf("httpRequest[%q] = %v, want %d", "requestBodyBytesRead", got, test.wantRead)
+			}
+			if _, got := httpReq["contentLengthMismatch"]; got != test.wantMismatch {
+				t.Errorf("httpRequest has contentLengthMismatch = %t, want %t", got, test.wantMismatch)
+			}
+		})
+	}
+}
+
+func TestMiddlewareWebhookSignatureLogging(t *testing.T) {
+	key := []byte("secret")
+	sign := func(body string) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	large := strings.Repeat("x", defaultMaxRequestReadBytes+1)
+
+	tests := []struct {
+		desc          string
+		body          string
+		sig           string
+		wantValid     bool
+		wantLevel     zapcore.Level
+		wantTruncated bool
+	}{
+		{
+			desc:      "valid",
+			body:      "payload",
+			sig:       sign("payload"),
+			wantValid: true,
+			wantLevel: zapcore.InfoLevel,
+		},
+		{
+			desc:      "invalid",
+			body:      "payload",
+			sig:       sign("other payload"),
+			wantLevel: zapcore.WarnLevel,
+		},
+		{
+			desc:      "missing header",
+			body:      "payload",
+			wantLevel: zapcore.WarnLevel,
+		},
+		{
+			desc:          "body over the default limit",
+			body:          large,
+			sig:           sign(large),
+			wantLevel:     zapcore.WarnLevel,
+			wantTruncated: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			var read int
+			h := NewMiddleware(zap.New(core), WithWebhookSignatureLogging("X-Hub-Signature-256", crypto.SHA256, key))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				read = len(body)
+				w.WriteHeader(http.StatusOK)
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+			if test.sig != "" {
+				r.Header.Set("X-Hub-Signature-256", test.sig)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if read != len(test.body) {
+				t.Errorf("handler read %d bytes, want %d", read, len(test.body))
+			}
+			if entries := logs.All(); len(entries) != 1 || entries[0].Level != test.wantLevel {
+				t.Fatalf("logged %v, want one entry at %v", entries, test.wantLevel)
+			}
+			httpReq := loggedObject(t, logs, "httpRequest")
+			if got := httpReq["webhookSignatureValid"]; got != test.wantValid {
+				t.Errorf("httpRequest[%q] = %v, want %t", "webhookSignatureValid", got, test.wantValid)
+			}
+			if got, _ := httpReq["requestBodyTruncated"].(bool); got != test.wantTruncated {
+				t.Errorf("httpRequest[%q] = %v, want %t", "requestBodyTruncated", httpReq["requestBodyTruncated"], test.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestMiddlewareJSONRequestBodyLogging(t *testing.T) {
+	tests := []struct {
+		desc        string
+		contentType string
+		body        string
+		want        interface{}
+	}{
+		{
+			desc:        "redacted",
+			contentType: "application/json",
+			body:        `{"user": {"name": "alice", "password": "hunter2"}}`,
+			want:        map[string]interface{}{"user": map[string]interface{}{"name": "alice", "password": "***"}},
+		},
+		{
+			desc:        "too large",
+			contentType: "application/json",
+			body:        `{"user": "` + strings.Repeat("a", 100) + `"}`,
+		},
+		{
+			desc:        "not JSON",
+			contentType: "text/plain",
+			body:        `{"user": "alice"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			var read string
+			h := NewMiddleware(zap.New(core), WithJSONRequestBodyLogging([]string{"user.password"}, 64))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				read = string(body)
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+			r.Header.Set("Content-Type", test.contentType)
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if read != test.body {
+				t.Errorf("handler read %q, want %q", read, test.body)
+			}
+			if got := loggedObject(t, logs, "httpRequest")["requestBody"]; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("httpRequest[%q] = %v, want %v", "requestBody", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareRequestBodyIntegrity(t *testing.T) {
+	key := []byte("secret")
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("payload"))
+	validSig := hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		desc      string
+		sig       string
+		wantValid bool
+		wantLevel zapcore.Level
+	}{
+		{desc: "valid", sig: validSig, wantValid: true, wantLevel: zapcore.InfoLevel},
+		{desc: "invalid", sig: hex.EncodeToString([]byte("forged")), wantLevel: zapcore.WarnLevel},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			var read string
+			h := NewMiddleware(zap.New(core), WithRequestBodyIntegrity("X-Body-HMAC", key))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				read = string(body)
+				w.WriteHeader(http.StatusOK)
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload"))
+			r.Header.Set("X-Body-HMAC", test.sig)
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if read != "payload" {
+				t.Errorf("handler read %q, want %q", read, "payload")
+			}
+			if got := loggedObject(t, logs, "httpRequest")["bodyIntegrityValid"]; got != test.wantValid {
+				t.Errorf("httpRequest[%q] = %v, want %t", "bodyIntegrityValid", got, test.wantValid)
+			}
+			if got := logs.All()[0].Level; got != test.wantLevel {
+				t.Errorf("logged at %v, want %v", got, test.wantLevel)
+			}
+		})
+	}
+}
+
+func TestMiddlewareMaxRequestReadBytes(t *testing.T) {
+	tests := []struct {
+		desc          string
+		maxBytes      int64
+		wantBody      bool
+		wantTruncated bool
+	}{
+		{desc: "under the limit", maxBytes: 1024, wantBody: true},
+		{desc: "over the limit", maxBytes: 8, wantTruncated: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			body := `{"user": "alice"}`
+			var read string
+			h := NewMiddleware(zap.New(core),
+				WithJSONRequestBodyLogging(nil, 1024),
+				WithMaxRequestReadBytes(test.maxBytes),
+			)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				read = string(b)
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if read != body {
+				t.Errorf("handler read %q, want %q", read, body)
+			}
+			httpReq := loggedObject(t, logs, "httpRequest")
+			if _, got := httpReq["requestBody"]; got != test.wantBody {
+				t.Errorf("httpRequest has requestBody = %t, want %t", got, test.wantBody)
+			}
+			if _, got := httpReq["requestBodyTruncated"]; got != test.wantTruncated {
+				t.Errorf("httpRequest has requestBodyTruncated = %t, want %t", got, test.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestMiddlewareRequestBodyPreview(t *testing.T) {
+	tests := []struct {
+		desc string
+		body string
+		want interface{}
+	}{
+		{desc: "short body", body: "hello", want: "hello"},
+		{desc: "long body read byte by byte", body: "hello world, this is a long body", want: "hello worl"},
+		{desc: "no body", body: "", want: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithRequestBodyPreview(10))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+			}))
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			if test.body != "" {
+				// Reading a byte at a time, like a body arriving over several network
+				// reads, exercises the preview's limit across writes.
+				req.Body = io.NopCloser(iotest.OneByteReader(strings.NewReader(test.body)))
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got := loggedObject(t, logs, "httpRequest")["requestBodyPreview"]; got != test.want {
+				t.Errorf("httpRequest[%q] = %v, want %v", "requestBodyPreview", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package zaphttplog
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap/zapcore"
+)
+
+// serverTimingWriter wraps a response writer to record the time to the first
+// byte of the response, and report it in the Server-Timing header just before
+// the header is written.
+type serverTimingWriter struct {
+	middleware.WrapResponseWriter
+	// start is when the handler was called.
+	start time.Time
+	// ttfb is the time from start until the header was written, once written
+	// is set.
+	ttfb    time.Duration
+	written bool
+}
+
+func (s *serverTimingWriter) WriteHeader(code int) {
+	s.setHeader()
+	s.WrapResponseWriter.WriteHeader(code)
+}
+
+func (s *serverTimingWriter) Write(p []byte) (int, error) {
+	s.setHeader()
+	return s.WrapResponseWriter.Write(p)
+}
+
+// withOptionalInterfaces returns s as a writer that implements http.Flusher,
+// http.Hijacker, http.Pusher and io.ReaderFrom only if the writer it wraps
+// does, in the combinations middleware.NewWrapResponseWriter returns.
+func (s *serverTimingWriter) withOptionalInterfaces() middleware.WrapResponseWriter {
+	_, fl := s.WrapResponseWriter.(http.Flusher)
+	hj, isHj := s.WrapResponseWriter.(http.Hijacker)
+	ps, isPs := s.WrapResponseWriter.(http.Pusher)
+	_, rf := s.WrapResponseWriter.(io.ReaderFrom)
+
+	switch {
+	case fl && isHj && rf:
+		return struct {
+			middleware.WrapResponseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{s, serverTimingFlusher{s}, hj, serverTimingReaderFrom{s}}
+	case fl && isHj:
+		return struct {
+			middleware.WrapResponseWriter
+			http.Flusher
+			http.Hijacker
+		}{s, serverTimingFlusher{s}, hj}
+	case fl && isPs:
+		return struct {
+			middleware.WrapResponseWriter
+			http.Flusher
+			http.Pusher
+		}{s, serverTimingFlusher{s}, ps}
+	case fl:
+		return struct {
+			middleware.WrapResponseWriter
+			http.Flusher
+		}{s, serverTimingFlusher{s}}
+	case isHj:
+		return struct {
+			middleware.WrapResponseWriter
+			http.Hijacker
+		}{s, hj}
+	}
+	return s
+}
+
+// serverTimingFlusher and serverTimingReaderFrom set the Server-Timing header
+// before the header is sent by a flush or copy on the writer s wraps.
+type serverTimingFlusher struct{ s *serverTimingWriter }
+
+func (f serverTimingFlusher) Flush() {
+	f.s.setHeader()
+	f.s.WrapResponseWriter.(http.Flusher).Flush()
+}
+
+type serverTimingReaderFrom struct{ s *serverTimingWriter }
+
+func (f serverTimingReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	f.s.setHeader()
+	return f.s.WrapResponseWriter.(io.ReaderFrom).ReadFrom(r)
+}
+
+// setHeader sets the Server-Timing header the first time it's called.
+func (s *serverTimingWriter) setHeader() {
+	if s.written {
+		return
+	}
+	s.written = true
+	s.ttfb = time.Since(s.start)
+	s.Header().Add("Server-Timing", "ttfb;dur="+serverTimingDur(s.ttfb))
+}
+
+// finish records the end of the handler, and returns the fields to log. If the
+// handler didn't write anything, the header is still unsent, so the total time
+// is added to the Server-Timing header too.
+func (s *serverTimingWriter) finish() []objEncoderFn {
+	total := time.Since(s.start)
+	if !s.written {
+		s.written = true
+		s.ttfb = total
+		s.Header().Add("Server-Timing", "total;dur="+serverTimingDur(total)+", ttfb;dur="+serverTimingDur(total))
+	}
+	ttfb := s.ttfb
+	return []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddDuration("serverTimingTotal", total); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddDuration("serverTimingTTFB", ttfb); return nil },
+	}
+}
+
+// serverTimingDur formats d in milliseconds, as Server-Timing durations are.
+func serverTimingDur(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64)
+}
@@ -0,0 +1,102 @@
+package zaphttplog
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestMiddlewareServerTiming(t *testing.T) {
+	tests := []struct {
+		desc       string
+		handler    http.HandlerFunc
+		wantHeader string
+	}{
+		{
+			desc: "written response",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+				time.Sleep(time.Millisecond)
+			},
+			wantHeader: "ttfb;dur=",
+		},
+		{
+			desc:       "empty response",
+			handler:    func(w http.ResponseWriter, r *http.Request) {},
+			wantHeader: "total;dur=",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			rec := httptest.NewRecorder()
+			NewMiddleware(zap.New(core), WithServerTiming(true))(test.handler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if got := rec.Header().Get("Server-Timing"); !strings.HasPrefix(got, test.wantHeader) {
+				t.Errorf("Server-Timing header = %q, want prefix %q", got, test.wantHeader)
+			}
+			httpResp := loggedObject(t, logs, "httpResponse")
+			total, _ := httpResp["serverTimingTotal"].(time.Duration)
+			ttfb, ok := httpResp["serverTimingTTFB"].(time.Duration)
+			if !ok || ttfb > total {
+				t.Errorf("serverTimingTTFB = %v, serverTimingTotal = %v, want a TTFB no greater than the total", httpResp["serverTimingTTFB"], httpResp["serverTimingTotal"])
+			}
+		})
+	}
+}
+
+func TestMiddlewareServerTimingOptionalInterfaces(t *testing.T) {
+	type interfaces struct {
+		flusher, hijacker, pusher, readerFrom bool
+	}
+	var got interfaces
+	h := NewMiddleware(zap.NewNop(), WithServerTiming(true))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, got.flusher = w.(http.Flusher)
+		_, got.hijacker = w.(http.Hijacker)
+		_, got.pusher = w.(http.Pusher)
+		rf, ok := w.(io.ReaderFrom)
+		got.readerFrom = ok
+		if ok {
+			rf.ReadFrom(strings.NewReader("ok"))
+		} else {
+			w.(http.Flusher).Flush()
+		}
+	}))
+
+	t.Run("recorder", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if want := (interfaces{flusher: true}); got != want {
+			t.Errorf("response writer implements %+v, want %+v", got, want)
+		}
+		if v := rec.Header().Get("Server-Timing"); !strings.HasPrefix(v, "ttfb;dur=") {
+			t.Errorf("Server-Timing header after Flush = %q, want prefix %q", v, "ttfb;dur=")
+		}
+	})
+
+	t.Run("HTTP/1.1 server", func(t *testing.T) {
+		srv := httptest.NewServer(h)
+		defer srv.Close()
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("http.Get: %v", err)
+		}
+		resp.Body.Close()
+
+		if want := (interfaces{flusher: true, hijacker: true, readerFrom: true}); got != want {
+			t.Errorf("response writer implements %+v, want %+v", got, want)
+		}
+		if v := resp.Header.Get("Server-Timing"); !strings.HasPrefix(v, "ttfb;dur=") {
+			t.Errorf("Server-Timing header after ReadFrom = %q, want prefix %q", v, "ttfb;dur=")
+		}
+	})
+}
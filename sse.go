@@ -0,0 +1,73 @@
+package zaphttplog
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// isEventStream reports whether the response is a Server-Sent Events stream.
+func isEventStream(header http.Header) bool {
+	return strings.Contains(header.Get("Content-Type"), "text/event-stream")
+}
+
+// sseEventCounter is tee'd the body of a response to count the Server-Sent
+// Events written to it. Events are terminated by a blank line, and lines
+// starting with a colon are comments, so a stream of keep-alive comments isn't
+// counted as events. See
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+type sseEventCounter struct {
+	// onEvent, if set, is called with the number of events written so far
+	// whenever an event is completed.
+	onEvent func(count int)
+
+	// started is the time the first byte of the stream was written.
+	started time.Time
+	count   int
+	// lineLen is the length of the current line, and pending is set once the
+	// current event has a line that isn't a comment.
+	lineLen int
+	pending bool
+}
+
+func (s *sseEventCounter) Write(p []byte) (int, error) {
+	if s.started.IsZero() && len(p) > 0 {
+		s.started = time.Now()
+	}
+	for _, b := range p {
+		switch b {
+		case '\r':
+			// Only CRLF line endings are supported, not lone CRs.
+		case '\n':
+			if s.lineLen == 0 && s.pending {
+				s.count++
+				s.pending = false
+				if s.onEvent != nil {
+					s.onEvent(s.count)
+				}
+			}
+			s.lineLen = 0
+		default:
+			if s.lineLen == 0 && b != ':' {
+				s.pending = true
+			}
+			s.lineLen++
+		}
+	}
+	return len(p), nil
+}
+
+// fields returns the "sseEventCount" and "sseDuration" fields, the latter
+// measured from when the stream was first written to.
+func (s *sseEventCounter) fields() []objEncoderFn {
+	var dur time.Duration
+	if !s.started.IsZero() {
+		dur = time.Since(s.started)
+	}
+	return []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddInt("sseEventCount", s.count); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddDuration("sseDuration", dur); return nil },
+	}
+}
@@ -0,0 +1,106 @@
+package zaphttplog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestSSEEventCounter(t *testing.T) {
+	tests := []struct {
+		desc   string
+		writes []string
+		want   int
+	}{
+		{
+			desc:   "single event",
+			writes: []string{"data: hello\n\n"},
+			want:   1,
+		},
+		{
+			desc:   "multi-line events split across writes",
+			writes: []string{"event: update\ndata: a\nda", "ta: b\n", "\ndata: c\r\n\r\n"},
+			want:   2,
+		},
+		{
+			desc:   "comments only",
+			writes: []string{": keep-alive\n\n", ": keep-alive\n\n"},
+			want:   0,
+		},
+		{
+			desc:   "unterminated event",
+			writes: []string{"data: a\n\ndata: b\n"},
+			want:   1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			var s sseEventCounter
+			for _, w := range test.writes {
+				s.Write([]byte(w))
+			}
+			if s.count != test.want {
+				t.Errorf("counted %d events, want %d", s.count, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareSSELogging(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithSSELogging(true))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			w.Write([]byte("data: tick\n\n"))
+		}
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/events", nil))
+
+	events := logs.FilterLevelExact(zapcore.DebugLevel).FilterField(zap.String("event", "sseEvent")).All()
+	if len(events) != 3 {
+		t.Errorf("%d sseEvent lines were logged at Debug level, want 3", len(events))
+	}
+	for _, e := range events {
+		httpReq, _ := e.ContextMap()["httpRequest"].(map[string]interface{})
+		if got := httpReq["requestPath"]; got != "/events" {
+			t.Errorf("sseEvent httpRequest[%q] = %v, want %q", "requestPath", got, "/events")
+		}
+	}
+	final := logs.FilterLevelExact(zapcore.InfoLevel).All()
+	if len(final) != 1 {
+		t.Fatalf("%d lines were logged at Info level, want 1", len(final))
+	}
+	httpResp, ok := final[0].ContextMap()["httpResponse"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("log line has no httpResponse object")
+	}
+	if got := httpResp["sseEventCount"]; got != 3 {
+		t.Errorf("httpResponse[%q] = %v, want 3", "sseEventCount", got)
+	}
+	if _, ok := httpResp["sseDuration"]; !ok {
+		t.Errorf("httpResponse has no %q field", "sseDuration")
+	}
+}
+
+func TestMiddlewareSSELoggingExtraLoggers(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	extraCore, extraLogs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithSSELogging(true), WithExtraLoggers(zap.New(extraCore)))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 2; i++ {
+			w.Write([]byte("data: tick\n\n"))
+		}
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/events", nil))
+
+	for name, l := range map[string]*observer.ObservedLogs{"logger": logs, "extra logger": extraLogs} {
+		if got := l.FilterField(zap.String("event", "sseEvent")).Len(); got != 2 {
+			t.Errorf("%d sseEvent lines were written to the %s, want 2", got, name)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package zaphttplog
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// NewTransport returns an http.RoundTripper that logs each outbound request made
+// with base, or http.DefaultTransport if base is nil, with "httpRequest" and
+// "httpResponse" fields like those NewMiddleware logs for inbound requests.
+// When the outbound request is made with the context of an inbound request
+// handled by NewMiddleware, it's logged with the inbound request's logger (see
+// LoggerFromContext) and request ID, so the two can be tied together.
+func NewTransport(logger *zap.Logger, base http.RoundTripper, options ...Option) http.RoundTripper {
+	opts := newOptions(options)
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &loggingTransport{
+		logger: opts.withDefaultFields(logger),
+		base:   base,
+		opts:   opts,
+	}
+}
+
+type loggingTransport struct {
+	logger *zap.Logger
+	base   http.RoundTripper
+	opts   *Options
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t1 := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	elapsed := time.Since(t1)
+
+	logger := t.logger
+	if l := LoggerFromContext(req.Context()); l != nil {
+		logger = l
+	}
+
+	msg := fmt.Sprintf("%s %s - ", req.Method, req.URL.Redacted())
+	reqField := zap.Object("httpRequest", mapFieldNames(toMarshaler(outboundRequestFields(req, t.opts)), t.opts.fieldNameMapper()))
+	if err != nil {
+		logger.Error(msg+"error", reqField, zap.Error(err))
+		return resp, err
+	}
+
+	status := resp.StatusCode
+	logStatus := status
+	if translated, ok := t.opts.StatusCodeTranslations[status]; ok {
+		logStatus = translated
+	}
+	fields := []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddInt("status", status); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddDuration("elapsed", elapsed); return nil },
+	}
+	if !t.opts.Concise && len(resp.Header) > 0 {
+		fields = append(fields, func(enc zapcore.ObjectEncoder) error {
+			return enc.AddObject(headersKey(t.opts.ResponseHeadersKey), toMarshaler(headerLogField(resp.Header, t.opts)))
+		})
+	}
+	respField := zap.Object("httpResponse", mapFieldNames(toMarshaler(fields), t.opts.fieldNameMapper()))
+	levelFunc(logger, statusLogLevel(logStatus))(fmt.Sprintf("%s%d %s", msg, status, statusLabel(logStatus)), reqField, respField)
+	return resp, nil
+}
+
+// outboundRequestFields returns the fields of the "httpRequest" object for an
+// outbound request. The URL is logged without any password it contains.
+func outboundRequestFields(req *http.Request, opts *Options) []objEncoderFn {
+	requestURL := req.URL.Redacted()
+	fields := []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("requestURL", requestURL); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("requestMethod", req.Method); return nil },
+	}
+	if reqID := requestID(req.Context()); reqID != "" {
+		fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("requestID", reqID); return nil })
+	}
+	if corrID := GetCorrelationID(req.Context()); corrID != "" {
+		fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("correlationID", corrID); return nil })
+	}
+	if !opts.Concise && len(req.Header) > 0 {
+		fields = append(fields, func(enc zapcore.ObjectEncoder) error {
+			return enc.AddObject(headersKey(opts.RequestHeadersKey), toMarshaler(headerLogField(req.Header, opts)))
+		})
+	}
+	return fields
+}
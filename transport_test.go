@@ -0,0 +1,49 @@
+package zaphttplog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestTransport(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	defer backend.Close()
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(core)
+	client := &http.Client{Transport: NewTransport(logger, nil)}
+	mw := NewMiddleware(logger, WithReqIDGenerator(func(*http.Request) string { return "req-1" }))
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, backend.URL+"/missing", nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest: %v", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		resp.Body.Close()
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if logs.Len() != 2 {
+		t.Fatalf("%d lines were logged, want 2", logs.Len())
+	}
+	outbound := logs.All()[0]
+	if got, want := outbound.Message, "GET "+backend.URL+"/missing - 404 Client Error"; got != want {
+		t.Errorf("log message = %q, want %q", got, want)
+	}
+	httpReq, _ := outbound.ContextMap()["httpRequest"].(map[string]interface{})
+	if got := httpReq["requestID"]; got != "req-1" {
+		t.Errorf("httpRequest[%q] = %v, want %q", "requestID", got, "req-1")
+	}
+	httpResp, _ := outbound.ContextMap()["httpResponse"].(map[string]interface{})
+	if got := httpResp["status"]; got != http.StatusNotFound {
+		t.Errorf("httpResponse[%q] = %v, want %d", "status", got, http.StatusNotFound)
+	}
+}
@@ -6,257 +6,3002 @@ package zaphttplog
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	_ "crypto/sha256" // for crypto.SHA256 in WithRequestBodyIntegrity
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
 var defaultOptions = Options{
-	Concise:     false,
-	SkipHeaders: nil,
+	Concise:               false,
+	SkipHeaders:           nil,
+	ResponseBodySizeField: true,
 }
 
 type Option func(*Options)
 
+// Middleware is the type of the middleware returned by this package. It's an
+// alias, so it can be passed directly to chi's Router.Use, or anywhere else
+// standard net/http middleware is accepted.
+type Middleware = func(next http.Handler) http.Handler
+
 func WithConcise(v bool) Option {
 	return func(o *Options) { o.Concise = v }
 }
 
-func WithSkipHeaders(headersToSkip []string) Option {
-	return func(o *Options) { o.SkipHeaders = headersToSkip }
+func WithSkipHeaders(headersToSkip []string) Option {
+	return func(o *Options) { o.SkipHeaders = headersToSkip }
+}
+
+// WithIngressHeaders logs the client-facing host and URL set by proxies.
+func WithIngressHeaders(v bool) Option {
+	return func(o *Options) { o.IngressHeaders = v }
+}
+
+// WithDefaultFields adds fields to the top level of every log line written by
+// the middleware. It can be specified multiple times, and the fields accumulate.
+func WithDefaultFields(fields ...zap.Field) Option {
+	return func(o *Options) { o.DefaultFields = append(o.DefaultFields, fields...) }
+}
+
+// WithEnvironment adds an "env" field with the given deployment environment,
+// e.g. "staging", to the top level of every log line. It's a no-op if env is
+// empty.
+func WithEnvironment(env string) Option {
+	return func(o *Options) {
+		if env != "" {
+			o.Environment = env
+			WithDefaultFields(zap.String("env", env))(o)
+		}
+	}
+}
+
+// WithEnvironmentFilter leaves the given fields out of the log lines when the
+// environment set with WithEnvironment or WithEnvironmentFromEnv is env, e.g. to
+// omit timing details in development. It can be specified once per
+// environment.
+func WithEnvironmentFilter(env string, suppressFields []string) Option {
+	return func(o *Options) {
+		if o.EnvironmentSuppressedFields == nil {
+			o.EnvironmentSuppressedFields = make(map[string][]string)
+		}
+		o.EnvironmentSuppressedFields[env] = suppressFields
+	}
+}
+
+// WithEnvironmentFromEnv is like WithEnvironment, but reads the environment
+// from the given environment variable when the middleware is created.
+func WithEnvironmentFromEnv(envVar string) Option {
+	return func(o *Options) { WithEnvironment(os.Getenv(envVar))(o) }
+}
+
+// WithVerboseOnlyFields adds the fields returned by fn to "httpRequest", unless
+// Concise is set, in which case fn isn't called. This is meant for fields that
+// are expensive to compute.
+func WithVerboseOnlyFields(fn func(r *http.Request) []zap.Field) Option {
+	return func(o *Options) { o.VerboseOnlyFields = fn }
+}
+
+// WithErrorResponseParser logs the error code and message parsed by fn.
+func WithErrorResponseParser(fn func(contentType string, body []byte) (code string, message string)) Option {
+	return func(o *Options) { o.ErrorResponseParser = fn }
+}
+
+// WithWebhookSignatureLogging verifies the HMAC signature of incoming webhook
+// request bodies against the signature in secretHeader, e.g.
+// WithWebhookSignatureLogging("X-Hub-Signature-256", crypto.SHA256, secret).
+// The hash function must be linked into the binary.
+func WithWebhookSignatureLogging(secretHeader string, algo crypto.Hash, secret []byte) Option {
+	return func(o *Options) {
+		o.WebhookSignatureHeader = secretHeader
+		o.WebhookSignatureHash = algo
+		o.WebhookSecret = secret
+	}
+}
+
+// WithPreLogHook calls fn immediately before the request log line is written.
+func WithPreLogHook(fn func(r *http.Request, status int, elapsed time.Duration)) Option {
+	return func(o *Options) { o.PreLogHook = fn }
+}
+
+// WithPostLogHook calls fn immediately after the request log line is written.
+func WithPostLogHook(fn func(r *http.Request, status int, elapsed time.Duration)) Option {
+	return func(o *Options) { o.PostLogHook = fn }
+}
+
+// WithH2PushLogging logs the targets of HTTP/2 server pushes.
+func WithH2PushLogging(v bool) Option {
+	return func(o *Options) { o.H2PushLogging = v }
+}
+
+// WithTenantLogger selects the logger to use for each request.
+func WithTenantLogger(fn func(*http.Request) *zap.Logger) Option {
+	return func(o *Options) { o.TenantLogger = fn }
+}
+
+// WithBodyContentTypeAllowList only captures bodies of the given media types.
+func WithBodyContentTypeAllowList(types []string) Option {
+	return func(o *Options) { o.BodyContentTypeAllowList = types }
+}
+
+// WithRequestLog writes an extra line at level when each request is received.
+func WithRequestLog(level zapcore.Level) Option {
+	return func(o *Options) {
+		o.LogRequestStart = true
+		o.RequestLogLevel = level
+	}
+}
+
+// WithPathNormalizer logs the canonical form of the path returned by fn.
+func WithPathNormalizer(fn func(r *http.Request) string) Option {
+	return func(o *Options) { o.PathNormalizer = fn }
+}
+
+// WithBodyLogFormat sets how captured bodies are encoded in the logs.
+func WithBodyLogFormat(format BodyLogFormat) Option {
+	return func(o *Options) { o.BodyLogFormat = format }
+}
+
+// WithLogCookieNames logs the names, but not the values, of request cookies.
+func WithLogCookieNames(v bool) Option {
+	return func(o *Options) { o.LogCookieNames = v }
+}
+
+// WithGRPCStatusLogging logs the status and message trailers of gRPC responses.
+func WithGRPCStatusLogging(v bool) Option {
+	return func(o *Options) { o.GRPCStatusLogging = v }
+}
+
+// WithOpenAPIOperationID logs the OpenAPI operation ID found by lookup.
+func WithOpenAPIOperationID(lookup func(method, pattern string) string) Option {
+	return func(o *Options) { o.OpenAPIOperationID = lookup }
+}
+
+// NoopOperationIDLookup is an operation ID lookup for WithOpenAPIOperationID
+// that never finds an operation ID.
+func NoopOperationIDLookup(method, pattern string) string {
+	return ""
+}
+
+// WithStructuredQueryParams logs query parameters, redacting redactKeys.
+func WithStructuredQueryParams(redactKeys []string) Option {
+	return func(o *Options) {
+		o.StructuredQueryParams = true
+		o.QueryParamRedactKeys = redactKeys
+	}
+}
+
+// WithAccessLogWriter also writes Apache Combined Log Format lines to w.
+func WithAccessLogWriter(w io.Writer) Option {
+	return func(o *Options) { o.AccessLogWriter = w }
+}
+
+// WithReqIDGenerator generates IDs for requests that don't already have one.
+func WithReqIDGenerator(fn func(*http.Request) string) Option {
+	return func(o *Options) { o.ReqIDGenerator = fn }
+}
+
+// WithJSONRequestBodyLogging logs JSON request bodies of up to maxBytes.
+func WithJSONRequestBodyLogging(redactFields []string, maxBytes int) Option {
+	return func(o *Options) {
+		o.JSONRequestBodyRedactFields = redactFields
+		o.JSONRequestBodyMaxBytes = maxBytes
+	}
+}
+
+// WithPerformanceProfile logs the memory stats delta of each request.
+func WithPerformanceProfile(v bool) Option {
+	return func(o *Options) { o.PerformanceProfile = v }
+}
+
+// WithRequestBodyIntegrity verifies the HMAC-SHA256 of request bodies.
+func WithRequestBodyIntegrity(secretHeader string, key []byte) Option {
+	return func(o *Options) {
+		o.BodyIntegrityHeader = secretHeader
+		o.BodyIntegrityKey = key
+	}
+}
+
+// WithClientCertLogging logs the details of mutual TLS client certificates.
+func WithClientCertLogging(v bool) Option {
+	return func(o *Options) { o.ClientCertLogging = v }
+}
+
+// WithRequestCountHeader sets and logs the request count of each connection.
+func WithRequestCountHeader(headerName string) Option {
+	return func(o *Options) { o.RequestCountHeader = headerName }
+}
+
+// WithExtraLoggers also writes the log lines to loggers.
+func WithExtraLoggers(loggers ...*zap.Logger) Option {
+	return func(o *Options) { o.ExtraLoggers = loggers }
+}
+
+// WithContextDeadlineLogging logs the deadline of the request context.
+func WithContextDeadlineLogging(v bool) Option {
+	return func(o *Options) { o.ContextDeadlineLogging = v }
+}
+
+// WithResponseBodyCondition adds a condition under which the response body is
+// captured and logged, replacing the default of capturing bodies for error (>=
+// 400) responses. It can be specified multiple times, and the body is captured
+// if any condition matches.
+func WithResponseBodyCondition(fn func(status int) bool) Option {
+	return func(o *Options) { o.ResponseBodyConditions = append(o.ResponseBodyConditions, fn) }
+}
+
+// WithCaptureBodyForCodes captures and logs the response body for responses
+// with any of the given status codes. Like WithResponseBodyCondition, it
+// replaces the default of capturing bodies for error responses, and can be
+// specified multiple times, and the codes accumulate.
+func WithCaptureBodyForCodes(codes ...int) Option {
+	return func(o *Options) {
+		if o.CaptureBodyCodes == nil {
+			o.CaptureBodyCodes = make(map[int]struct{}, len(codes))
+		}
+		for _, code := range codes {
+			o.CaptureBodyCodes[code] = struct{}{}
+		}
+	}
+}
+
+// WithFieldNameMapper renames the fields of "httpRequest" and "httpResponse".
+func WithFieldNameMapper(fn func(name string) string) Option {
+	return func(o *Options) { o.FieldNameMapper = fn }
+}
+
+// WithFieldPrefix prefixes the names of the fields in "httpRequest" and
+// "httpResponse" with prefix and an underscore, e.g. "bytes" becomes
+// "<prefix>_bytes". It's implemented as a FieldNameMapper, and replaces any
+// other mapper.
+func WithFieldPrefix(prefix string) Option {
+	return WithFieldNameMapper(func(name string) string { return prefix + "_" + name })
+}
+
+// WithStatusCodeTranslation maps non-standard status codes to standard ones.
+func WithStatusCodeTranslation(translations map[int]int) Option {
+	return func(o *Options) { o.StatusCodeTranslations = translations }
+}
+
+// WithTeeWriter copies the response body to w as it's written.
+func WithTeeWriter(w io.Writer) Option {
+	return func(o *Options) { o.TeeWriter = w }
+}
+
+// WithDurationBudgetFunc logs the share of its latency budget a request used.
+func WithDurationBudgetFunc(fn func(*http.Request) time.Duration) Option {
+	return func(o *Options) { o.DurationBudgetFunc = fn }
+}
+
+// WithChiURLParams logs the URL parameters of the matched chi route.
+func WithChiURLParams(enabled bool) Option {
+	return func(o *Options) { o.ChiURLParams = enabled }
+}
+
+// WithURLParamRedactor redacts the values of the chi URL parameters, logged
+// with WithChiURLParams, that redact reports as sensitive.
+func WithURLParamRedactor(redact func(key, value string) bool) Option {
+	return func(o *Options) { o.URLParamRedactor = redact }
+}
+
+// WithPathParamExtractor logs the path parameters returned by fn, for routers
+// other than chi. See the gorillamux and httprouter packages.
+func WithPathParamExtractor(fn func(r *http.Request) map[string]string) Option {
+	return func(o *Options) { o.PathParamExtractor = fn }
+}
+
+// WithAccessTokenPrefix logs the first n characters of bearer tokens in the
+// Authorization header, e.g. "Bearer eyJhbGci...", to correlate requests made
+// with the same token without logging it in full. If n is zero, the header is
+// fully redacted, which is the default.
+func WithAccessTokenPrefix(n int) Option {
+	return func(o *Options) { o.AccessTokenPrefix = n }
+}
+
+// WithElideDuplicateFields skips default fields that are already on the
+// logger. Only fields added after the logger was wrapped with TrackLoggerFields
+// are known.
+func WithElideDuplicateFields(v bool) Option {
+	return func(o *Options) { o.ElideDuplicateFields = v }
+}
+
+// WithLogID logs a sequence number to detect gaps in shipped logs.
+func WithLogID(v bool) Option {
+	return func(o *Options) { o.LogID = v }
+}
+
+// WithErrorRateWindow logs the percentage of requests over the last window that
+// got a 5xx response, counted in the given number of buckets. More buckets make
+// the window slide more smoothly at the cost of a little more work per request.
+func WithErrorRateWindow(window time.Duration, buckets int) Option {
+	return func(o *Options) {
+		o.ErrorRateWindow = window
+		o.ErrorRateBuckets = buckets
+	}
+}
+
+// WithDefaultStatus uses status in place of 0 to pick the log level.
+func WithDefaultStatus(status int) Option {
+	return func(o *Options) { o.DefaultStatus = status }
+}
+
+// WithRangeRequestLogging logs the range of 206 Partial Content responses.
+func WithRangeRequestLogging(v bool) Option {
+	return func(o *Options) { o.RangeRequestLogging = v }
+}
+
+// WithRequestBodyPreview logs up to n bytes of the request body.
+func WithRequestBodyPreview(n int) Option {
+	return func(o *Options) { o.RequestBodyPreview = n }
+}
+
+// WithServerContext sets the server context, see Options.ServerContext.
+func WithServerContext(ctx context.Context) Option {
+	return func(o *Options) { o.ServerContext = ctx }
+}
+
+// WithBodyCaptureMaxAge skips the bodies of requests that took longer than d.
+func WithBodyCaptureMaxAge(d time.Duration) Option {
+	return func(o *Options) { o.BodyCaptureMaxAge = d }
+}
+
+// WithAdaptiveBodyCapture captures up to incidentLimit bytes of response bodies,
+// instead of baseLimit, while more than errorThreshold 5xx responses were sent
+// over the last window, to get more context during incidents.
+func WithAdaptiveBodyCapture(baseLimit, incidentLimit int, errorThreshold int, window time.Duration) Option {
+	return func(o *Options) {
+		o.BodyCaptureLimit = baseLimit
+		o.IncidentBodyCaptureLimit = incidentLimit
+		o.IncidentErrorThreshold = errorThreshold
+		o.IncidentWindow = window
+	}
+}
+
+// WithEchoCorrelationHeader copies the correlation ID that clients send in
+// requestHeader to responseHeader in the response, and logs it as
+// "correlationID". Unlike NewCorrelationMiddleware, no ID is generated when
+// the request doesn't have one. If responseHeader is empty, it's the same as
+// requestHeader.
+func WithEchoCorrelationHeader(requestHeader, responseHeader string) Option {
+	if responseHeader == "" {
+		responseHeader = requestHeader
+	}
+	return func(o *Options) {
+		o.EchoCorrelationRequestHeader = requestHeader
+		o.EchoCorrelationResponseHeader = responseHeader
+	}
+}
+
+// WithRetryAfterLogging logs the Retry-After header of 429 responses.
+func WithRetryAfterLogging(v bool) Option {
+	return func(o *Options) { o.RetryAfterLogging = v }
+}
+
+// WithBotDetectionLogging logs "isBot" for requests whose User-Agent matches
+// any of the patterns, e.g. those from DefaultBotPatterns.
+func WithBotDetectionLogging(patterns []*regexp.Regexp) Option {
+	return func(o *Options) { o.BotPatterns = patterns }
+}
+
+// WithDeprecationRegistry logs requests to deprecated endpoints.
+func WithDeprecationRegistry(registry DeprecationRegistry) Option {
+	return func(o *Options) { o.DeprecationRegistry = registry }
+}
+
+// WithLatencyPercentileTracker logs the latency percentiles of endpoints.
+func WithLatencyPercentileTracker(tracker LatencyTracker) Option {
+	return func(o *Options) { o.LatencyTracker = tracker }
+}
+
+// WithConcurrentRequestGauge logs the number of requests in flight.
+func WithConcurrentRequestGauge(v bool) Option {
+	return func(o *Options) { o.ConcurrentRequestGauge = v }
+}
+
+// WithResponseBodyDecoding decodes logged bodies per their Content-Encoding.
+func WithResponseBodyDecoding(v bool) Option {
+	return func(o *Options) { o.ResponseBodyDecoding = v }
+}
+
+// WithRequestMeter logs the tokens each request consumed, as counted by fn.
+func WithRequestMeter(fn func(r *http.Request, respBody []byte) (inputTokens, outputTokens int)) Option {
+	return func(o *Options) { o.RequestMeter = fn }
+}
+
+// WithCircuitBreakerStatus logs the circuit breaker state returned by fn.
+func WithCircuitBreakerStatus(fn func(r *http.Request) string) Option {
+	return func(o *Options) { o.CircuitBreakerStatus = fn }
+}
+
+// WithFeatureFlagLogger logs the feature flags evaluated for the request.
+func WithFeatureFlagLogger(fn func(ctx context.Context) map[string]bool) Option {
+	return func(o *Options) { o.FeatureFlagLogger = fn }
+}
+
+// WithContentNegotiationLogging logs the Accept and Content-Type headers.
+func WithContentNegotiationLogging(v bool) Option {
+	return func(o *Options) { o.ContentNegotiationLogging = v }
+}
+
+// WithMiddlewareID adds a "middlewareID" field with the given ID, e.g.
+// "auth-layer", to the top level of every log line, to tell apart the lines of
+// chained middleware. If id is empty, a random UUID is generated when the
+// option is created, so middleware sharing the option share the ID.
+func WithMiddlewareID(id string) Option {
+	if id == "" {
+		id = newUUID()
+	}
+	return func(o *Options) { o.MiddlewareID = id }
+}
+
+// WithSensitiveHeaderFn redacts the request and response headers for which fn
+// returns true, called with their lowercase names, instead of the Authorization,
+// Cookie and Set-Cookie headers. To redact more headers, fn can fall back to
+// DefaultSensitiveHeaderFn.
+func WithSensitiveHeaderFn(fn func(key string) bool) Option {
+	return func(o *Options) { o.SensitiveHeaderFn = fn }
+}
+
+// WithAlwaysLogScheme logs the scheme even when Concise is set.
+func WithAlwaysLogScheme(v bool) Option {
+	return func(o *Options) { o.AlwaysLogScheme = v }
+}
+
+// WithErrorBodyMinSize doesn't log captured bodies smaller than n bytes.
+func WithErrorBodyMinSize(n int) Option {
+	return func(o *Options) { o.ErrorBodyMinSize = n }
+}
+
+// WithGCPTraceContext logs the Cloud Trace fields of projectID.
+func WithGCPTraceContext(projectID string) Option {
+	return func(o *Options) { o.GCPTraceProjectID = projectID }
+}
+
+// WithHeadersObjectName renames the objects the headers are logged as.
+func WithHeadersObjectName(reqHeadersKey, respHeadersKey string) Option {
+	return func(o *Options) {
+		o.RequestHeadersKey = reqHeadersKey
+		o.ResponseHeadersKey = respHeadersKey
+	}
+}
+
+// WithMaxRequestReadBytes limits how much of the body the middleware reads.
+func WithMaxRequestReadBytes(n int64) Option {
+	return func(o *Options) { o.MaxRequestReadBytes = n }
+}
+
+// WithEnableVerboseHeader enables verbose logging for requests with the given
+// header set to secretValue, e.g. to debug specific requests during an incident
+// without making every log line noisier.
+func WithEnableVerboseHeader(headerName, secretValue string) Option {
+	return func(o *Options) {
+		o.VerboseHeader = headerName
+		o.VerboseHeaderSecret = secretValue
+	}
+}
+
+// WithResponseBodySizeField logs the response size as "responseSizeBytes".
+func WithResponseBodySizeField(v bool) Option {
+	return func(o *Options) { o.ResponseBodySizeField = v }
+}
+
+// WithContextLogField logs the value stored in the request context under key,
+// when it's set, in "httpResponse". The field is built with fn, or logged as
+// zapKey with zap.Any if fn is nil. It can be specified multiple times, and the
+// fields accumulate.
+func WithContextLogField(key interface{}, zapKey string, fn func(interface{}) zap.Field) Option {
+	return func(o *Options) {
+		o.ContextLogFields = append(o.ContextLogFields, ContextLogField{Key: key, Name: zapKey, Field: fn})
+	}
+}
+
+// ContextLogField describes a request context value to log. See
+// WithContextLogField.
+type ContextLogField struct {
+	Key   interface{}
+	Name  string
+	Field func(interface{}) zap.Field
+}
+
+// field returns the field to log for the given context value.
+func (f ContextLogField) field(v interface{}) zap.Field {
+	if f.Field == nil {
+		return zap.Any(f.Name, v)
+	}
+	return f.Field(v)
+}
+
+// WithResponseBodyHash logs the hash of the captured response body.
+func WithResponseBodyHash(algo crypto.Hash) Option {
+	return func(o *Options) { o.ResponseBodyHash = algo }
+}
+
+// WithRequestStartTime logs the time the request was received.
+func WithRequestStartTime(v bool) Option {
+	return func(o *Options) { o.RequestStartTime = v }
+}
+
+// WithOTelBaggageLogging logs the OpenTelemetry baggage members with keys.
+func WithOTelBaggageLogging(keys []string) Option {
+	return func(o *Options) { o.OTelBaggageKeys = keys }
+}
+
+// WithMaskedPathSegments redacts the parts of paths matching patterns.
+func WithMaskedPathSegments(patterns []*regexp.Regexp) Option {
+	return func(o *Options) { o.MaskedPathSegments = patterns }
+}
+
+// WithMetricsTagExtractor logs the metrics tags returned by fn.
+func WithMetricsTagExtractor(fn func(*http.Request) map[string]string) Option {
+	return func(o *Options) { o.MetricsTagExtractor = fn }
+}
+
+// WithCaptureBodyAlways captures response bodies regardless of the status.
+func WithCaptureBodyAlways(v bool) Option {
+	return func(o *Options) { o.CaptureBodyAlways = v }
+}
+
+// WithSecurityHeaderAudit logs the requiredHeaders missing from responses.
+func WithSecurityHeaderAudit(requiredHeaders []string) Option {
+	return func(o *Options) { o.RequiredSecurityHeaders = requiredHeaders }
+}
+
+// WithRequiredRequestHeaders logs the required headers missing from requests.
+func WithRequiredRequestHeaders(required []string) Option {
+	return func(o *Options) { o.RequiredRequestHeaders = required }
+}
+
+// WithCORSPreflightLevel logs CORS preflight requests, i.e. OPTIONS requests
+// answered with a 204, at lvl instead of the level derived from their status.
+func WithCORSPreflightLevel(lvl zapcore.Level) Option {
+	return func(o *Options) { o.CORSPreflightLevel = &lvl }
+}
+
+// WithHTTPSRedirectLogging logs redirects of HTTP requests to HTTPS.
+func WithHTTPSRedirectLogging(v bool) Option {
+	return func(o *Options) { o.HTTPSRedirectLogging = v }
+}
+
+// WithGRPCWebLogging logs the status and message of gRPC-Web responses.
+func WithGRPCWebLogging(v bool) Option {
+	return func(o *Options) { o.GRPCWebLogging = v }
+}
+
+// WithGRPCTrailerFields logs the values of the response trailers with keys.
+func WithGRPCTrailerFields(keys []string) Option {
+	return func(o *Options) { o.GRPCTrailerFields = keys }
+}
+
+// WithDeclareTrailerKeys declares the given trailers in the Trailer response
+// header before the handler runs, for handlers that send trailers without
+// declaring them.
+func WithDeclareTrailerKeys(keys []string) Option {
+	return func(o *Options) { o.DeclareTrailerKeys = keys }
+}
+
+// WithConcurrencyLimitChan limits the number of concurrent requests to the
+// capacity of ch, which is used as a semaphore and may be shared with other
+// middleware. A nil channel doesn't limit requests.
+func WithConcurrencyLimitChan(ch chan struct{}) Option {
+	return func(o *Options) { o.ConcurrencyLimit = ch }
+}
+
+// WithCDNCacheStatusLogging logs the CDN cache status in the headerName header.
+func WithCDNCacheStatusLogging(headerName string) Option {
+	return func(o *Options) { o.CDNCacheStatusHeader = headerName }
+}
+
+// WithCDNCacheHitValues sets the CDN cache statuses that are hits.
+func WithCDNCacheHitValues(values []string) Option {
+	return func(o *Options) { o.CDNCacheHitValues = values }
+}
+
+// WithServerTiming adds the time to first byte to the Server-Timing header.
+func WithServerTiming(v bool) Option {
+	return func(o *Options) { o.ServerTiming = v }
+}
+
+// WithActualRequestBodySize logs the number of request body bytes read.
+func WithActualRequestBodySize(v bool) Option {
+	return func(o *Options) { o.ActualRequestBodySize = v }
+}
+
+// WithContextErrorDetail logs why the request context was done.
+func WithContextErrorDetail(v bool) Option {
+	return func(o *Options) { o.ContextErrorDetail = v }
+}
+
+// WithTimeZone logs the times of the middleware in loc.
+func WithTimeZone(loc *time.Location) Option {
+	return func(o *Options) { o.TimeZone = loc }
+}
+
+// WithElasticCommonSchema logs requests with Elastic Common Schema names.
+func WithElasticCommonSchema(v bool) Option {
+	return func(o *Options) { o.ElasticCommonSchema = v }
+}
+
+// WithRequestSignature logs the string returned by fn as "requestSignature",
+// e.g. to group requests in rate-limiting dashboards. If fn is nil, the
+// signature is the method and the chi route pattern (or path), like
+// "GET:/users/{userID}".
+func WithRequestSignature(fn func(r *http.Request) string) Option {
+	if fn == nil {
+		fn = defaultRequestSignature
+	}
+	return func(o *Options) { o.RequestSignature = fn }
+}
+
+// WithAWSRequestID logs the request and trace IDs set by AWS.
+func WithAWSRequestID(v bool) Option {
+	return func(o *Options) { o.AWSRequestID = v }
+}
+
+// WithGeolocation logs the country of the remote IP, looked up in db.
+func WithGeolocation(db GeolocationDB) Option {
+	return func(o *Options) { o.GeolocationDB = db }
+}
+
+// WithSSELogging logs the events written to Server-Sent Events responses.
+func WithSSELogging(v bool) Option {
+	return func(o *Options) { o.SSELogging = v }
+}
+
+// BodyLogFormat determines how captured bodies are encoded in the logs.
+type BodyLogFormat int
+
+const (
+	// BodyLogUTF8 logs the raw body bytes as a string. This is the default.
+	BodyLogUTF8 BodyLogFormat = iota
+	// BodyLogHex logs the body as a hex-encoded string.
+	BodyLogHex
+	// BodyLogBase64 logs the body as a standard base64-encoded string.
+	BodyLogBase64
+	// BodyLogAuto logs the body as a string if it's valid UTF-8, and as a
+	// base64-encoded string otherwise.
+	BodyLogAuto
+)
+
+type Options struct {
+	// Concise mode includes fewer log details during the request flow. For example
+	// excluding details like request content length, user-agent and other details.
+	// This is useful if during development your console is too noisy.
+	Concise bool
+
+	// SkipHeaders are additional headers which are redacted from the logs
+	SkipHeaders []string
+
+	// IngressHeaders uses the X-Forwarded-Host and X-Original-URL headers set by
+	// reverse proxies like Kubernetes NGINX Ingress and Traefik (when present) to
+	// log the client-facing host and URL, instead of the internal proxied ones.
+	IngressHeaders bool
+
+	// DefaultFields are added to the top level of every log line.
+	DefaultFields []zap.Field
+
+	// ErrorResponseParser, if set, is called with the captured response body of
+	// error (>= 400) responses to extract an application-level error code and
+	// message, which are logged as "errorCode" and "errorMessage". Empty return
+	// values are not logged.
+	ErrorResponseParser func(contentType string, body []byte) (code string, message string)
+
+	// WebhookSignatureHeader, when set, is the request header containing an HMAC
+	// signature of the request body, computed with WebhookSignatureHash and
+	// WebhookSecret. The result of verifying the signature is logged as
+	// "webhookSignatureValid", and invalid signatures are logged at least at Warn
+	// level. The signature may be hex-encoded with an optional "<algo>=" prefix,
+	// as GitHub does with "sha256=<hex>". Bodies longer than
+	// MaxRequestReadBytes, or 1 MiB if it isn't set, can't be verified, and are
+	// logged as invalid, with "requestBodyTruncated".
+	WebhookSignatureHeader string
+	WebhookSignatureHash   crypto.Hash
+	WebhookSecret          []byte
+
+	// PreLogHook and PostLogHook are called immediately before and after the
+	// request log line is written, e.g. to measure the cost of logging. They
+	// don't affect the contents of the log line.
+	PreLogHook  func(r *http.Request, status int, elapsed time.Duration)
+	PostLogHook func(r *http.Request, status int, elapsed time.Duration)
+
+	// H2PushLogging logs the targets of any HTTP/2 server pushes issued by the
+	// handler as "pushedResources".
+	H2PushLogging bool
+
+	// TenantLogger, if set, selects the logger to use for each request, e.g. to
+	// send logs for each tenant of a multi-tenant application to their own sink.
+	// When it returns nil, the logger passed to NewMiddleware is used.
+	TenantLogger func(*http.Request) *zap.Logger
+
+	// BodyContentTypeAllowList restricts response body capture to responses with
+	// one of the given media types (e.g. "application/json"), ignoring any
+	// parameters like charset. When empty, bodies are captured regardless of
+	// their content type.
+	BodyContentTypeAllowList []string
+
+	// LogRequestStart writes an additional log line at RequestLogLevel when each
+	// request is received, with the "httpRequest" field and an "event" field of
+	// "incoming". This helps pinpoint requests that hang, as the regular log line
+	// is only written once the handler returns.
+	LogRequestStart bool
+	RequestLogLevel zapcore.Level
+
+	// PathNormalizer, if set, returns a canonical form of the request path (e.g.
+	// "/users/{id}/profile" for "/users/123/profile") to log as "requestPath" and
+	// in the log message, so logs can be aggregated by route. See
+	// ChiPatternNormalizer.
+	PathNormalizer func(r *http.Request) string
+
+	// BodyLogFormat determines how captured bodies are encoded in the logs, which
+	// matters mostly for binary bodies.
+	BodyLogFormat BodyLogFormat
+
+	// LogCookieNames logs the names (but not the values) of request cookies as
+	// "cookieNames", which can help debug session issues. The Cookie header itself
+	// is still redacted.
+	LogCookieNames bool
+
+	// GRPCStatusLogging logs the status code name and message from the
+	// grpc-status and grpc-message trailers of gRPC responses as "grpcStatus"
+	// and "grpcMessage".
+	GRPCStatusLogging bool
+
+	// OpenAPIOperationID, if set, looks up the OpenAPI operation ID for the
+	// method and chi route pattern of the request, which is logged as
+	// "operationId" when found.
+	OpenAPIOperationID func(method, pattern string) string
+
+	// StructuredQueryParams logs the request's query parameters as "queryParams",
+	// an array of {"key": ..., "value": ...} objects. This keeps the log schema
+	// stable regardless of which parameters clients send. The values of
+	// parameters in QueryParamRedactKeys, matched case-insensitively, are
+	// redacted, both there and in the query string wherever else it's logged,
+	// like "requestURL" and the access log.
+	StructuredQueryParams bool
+	QueryParamRedactKeys  []string
+
+	// AccessLogWriter, if set, receives a line in the Apache Combined Log Format
+	// for each request, after the structured log line is written, for use with
+	// tools like GoAccess. It must be safe for concurrent use.
+	AccessLogWriter io.Writer
+
+	// ReqIDGenerator, if set, generates an ID for requests that don't already
+	// have one, either from chi's middleware.RequestID or SetRequestID. The ID is
+	// logged as "requestID" and stored in the request context, where handlers can
+	// retrieve it with GetRequestID.
+	ReqIDGenerator func(*http.Request) string
+
+	// JSONRequestBodyMaxBytes, when positive, logs JSON object request bodies of
+	// up to that many bytes as "requestBody". Larger bodies aren't logged. The
+	// values of JSONRequestBodyRedactFields, which may be dot-separated paths to
+	// nested fields like "user.password", are redacted.
+	JSONRequestBodyMaxBytes     int
+	JSONRequestBodyRedactFields []string
+
+	// PerformanceProfile logs the change in the process' heap allocation, total
+	// allocation and GC count over the course of each request as "perfStats". This
+	// is useful for tracking down handlers that leak memory, but reading memory
+	// stats stops the world, so it shouldn't be left enabled in production.
+	PerformanceProfile bool
+
+	// BodyIntegrityHeader, when set, is the request header containing a
+	// hex-encoded HMAC-SHA256 of the request body, keyed with BodyIntegrityKey.
+	// The result of verifying it is logged as "bodyIntegrityValid", and failed
+	// checks are logged at least at Warn level. Bodies longer than
+	// MaxRequestReadBytes fail the check. The body is passed on to the handler
+	// either way.
+	BodyIntegrityHeader string
+	BodyIntegrityKey    []byte
+
+	// ClientCertLogging logs the subject, issuer, serial number (in hex) and
+	// expiration of the client certificate presented over mutual TLS, as
+	// "clientCertSubject", "clientCertIssuer", "clientCertSerial" and
+	// "clientCertExpiry".
+	ClientCertLogging bool
+
+	// RequestCountHeader, when set, is a response header that's set to the number
+	// of requests served so far on the request's connection, including the
+	// current one, which is also logged as "connRequestCount". This helps debug
+	// keep-alive behavior behind load balancers. Connections are identified by
+	// their remote address, and counts are best-effort: to bound memory use, all
+	// counts are reset after a large number of distinct connections.
+	RequestCountHeader string
+
+	// ExtraLoggers receive the same log lines as the logger passed to the
+	// middleware, e.g. to write access logs both to stdout and to a file for
+	// archival.
+	ExtraLoggers []*zap.Logger
+
+	// ContextDeadlineLogging logs the deadline of the request context, if it has
+	// one, as "contextDeadline", and adds "deadlineExceeded" to the response
+	// fields when the deadline was hit before the handler returned.
+	ContextDeadlineLogging bool
+
+	// ResponseBodyConditions and CaptureBodyCodes determine which responses have
+	// their body captured and logged, by status code. If any condition matches,
+	// or the status is one of the codes, the body is captured. When both are
+	// empty, bodies are captured for error (>= 400) responses. Bodies are only
+	// buffered for responses that will be logged.
+	ResponseBodyConditions []func(status int) bool
+	CaptureBodyCodes       map[int]struct{}
+
+	// FieldNameMapper, if set, renames the fields of the "httpRequest" and
+	// "httpResponse" objects, e.g. to avoid collisions in shared log pipelines.
+	// The fields of nested objects, like header names, aren't renamed.
+	FieldNameMapper func(name string) string
+
+	// Environment is the deployment environment set with WithEnvironment.
+	Environment string
+	// EnvironmentSuppressedFields maps deployment environments to names of
+	// fields to leave out of the log lines in them. Fields are matched by their
+	// name before FieldNameMapper is applied, either at the top level or in the
+	// "httpRequest" and "httpResponse" objects. Fields logged with
+	// ElasticCommonSchema and DefaultFields are always logged.
+	EnvironmentSuppressedFields map[string][]string
+
+	// VerboseOnlyFields, if set, returns fields to add to "httpRequest" unless
+	// Concise is set. It's only called when they're logged.
+	VerboseOnlyFields func(r *http.Request) []zap.Field
+
+	// StatusCodeTranslations maps non-standard status codes, like NGINX's 499
+	// Client Closed Request, to the standard status codes used to pick the label
+	// and level of their log lines. The actual status is still logged as
+	// "status".
+	StatusCodeTranslations map[int]int
+
+	// TeeWriter, if set, receives a copy of the response body as it's written,
+	// e.g. for audit middleware that also needs to see the response. Handlers
+	// can't tee the response writer themselves, since the middleware already
+	// does and only one writer can be tee'd at a time.
+	TeeWriter io.Writer
+
+	// DurationBudgetFunc, if set, returns the latency budget (e.g. from an SLA)
+	// for a request. The percentage of the budget consumed by the request is
+	// logged as "budgetConsumedPct", along with "budgetExceeded" if it went over.
+	// Non-positive budgets aren't logged.
+	DurationBudgetFunc func(*http.Request) time.Duration
+
+	// ChiURLParams logs the URL parameters of the matched chi route (e.g.
+	// {userID}) as the "urlParams" object. Values for which URLParamRedactor
+	// returns true are redacted.
+	ChiURLParams     bool
+	URLParamRedactor func(key, value string) bool
+
+	// ElideDuplicateFields leaves out any of DefaultFields whose name is already
+	// on the logger, as recorded by TrackLoggerFields.
+	ElideDuplicateFields bool
+
+	// LogID adds "logSeq", a sequence number that increases by one for each
+	// request handled by the middleware, so that gaps in shipped logs can be
+	// detected. The sequence restarts from 1 when the process does.
+	LogID bool
+
+	// ErrorRateWindow, if positive, adds "errorRatePct", the percentage of
+	// requests handled by the middleware over the last ErrorRateWindow that got
+	// a 5xx response. Requests are counted in ErrorRateBuckets buckets.
+	ErrorRateWindow  time.Duration
+	ErrorRateBuckets int
+
+	// DefaultStatus, if set, is used in place of a status of 0, e.g. when the
+	// handler panicked before writing anything, to pick the label and level of
+	// the log line. The logged "status" is still 0.
+	DefaultStatus int
+
+	// RangeRequestLogging logs the Content-Range of 206 Partial Content
+	// responses, e.g. from http.ServeContent, as "rangeStart", "rangeEnd" and
+	// "totalSize", which is "*" if the complete length is unknown.
+	RangeRequestLogging bool
+
+	// RequestBodyPreview, if positive, logs up to that many bytes of the request
+	// body, as read by the handler, as "requestBodyPreview", regardless of its
+	// content type. It's ignored for requests whose body is logged with
+	// JSONRequestBodyMaxBytes.
+	RequestBodyPreview int
+
+	// ServerContext, if set, is the context of the server, e.g. the one returned
+	// by its BaseContext. When it's done, NewConnectionMiddleware writes a
+	// "connection closed" line for each connection it has seen that's still
+	// open, i.e. all of them unless ConnectionLogger.ConnState is installed.
+	ServerContext context.Context
+
+	// BodyCaptureMaxAge, if positive, skips logging the captured response body of
+	// requests whose handler took longer than that, logging a placeholder
+	// instead, so slow handlers with large bodies don't also slow down logging.
+	BodyCaptureMaxAge time.Duration
+
+	// ErrorBodyMinSize is the size under which captured response bodies, like
+	// empty or single-character ones, aren't worth logging. The default of zero
+	// logs all of them.
+	ErrorBodyMinSize int
+
+	// BodyCaptureLimit is the maximum number of bytes of response bodies to
+	// capture, 512 if it isn't positive. If IncidentWindow is positive, up to
+	// IncidentBodyCaptureLimit bytes, if it's positive, are captured instead
+	// while more than IncidentErrorThreshold 5xx responses were sent over the
+	// last IncidentWindow.
+	BodyCaptureLimit         int
+	IncidentBodyCaptureLimit int
+	IncidentErrorThreshold   int
+	IncidentWindow           time.Duration
+
+	// EchoCorrelationRequestHeader, if set, is the request header clients send
+	// correlation IDs in. They're logged as "correlationID", and echoed back in
+	// the EchoCorrelationResponseHeader response header.
+	EchoCorrelationRequestHeader  string
+	EchoCorrelationResponseHeader string
+
+	// RetryAfterLogging logs the Retry-After header of 429 responses as
+	// "retryAfterSecs", or as "retryAfterRaw" if it can't be parsed.
+	RetryAfterLogging bool
+
+	// BotPatterns are matched against the User-Agent of requests, which are
+	// logged with "isBot" if any matches.
+	BotPatterns []*regexp.Regexp
+
+	// DeprecationRegistry, if set, reports deprecated endpoints, requests to
+	// which are logged with "deprecated" and "deprecationMessage".
+	DeprecationRegistry DeprecationRegistry
+
+	// LatencyTracker, if set, records the latency of each request, and the
+	// latency percentiles of its endpoint are logged as "p50ms", "p95ms" and
+	// "p99ms". Requests that didn't match a chi route are recorded under
+	// UnmatchedLatencyPath. See NewHDRLatencyTracker.
+	LatencyTracker LatencyTracker
+
+	// ConcurrentRequestGauge logs the number of other requests being handled by
+	// the middleware when each request starts, as "inFlightBefore", and when it
+	// finishes, as "inFlightAfter".
+	ConcurrentRequestGauge bool
+
+	// ResponseBodyDecoding decodes logged response bodies according to their
+	// Content-Encoding, which can be gzip, deflate or zstd. Bodies with other
+	// encodings, like Brotli, are logged as-is with their encoding as
+	// "bodyEncoding". The response body hash is of the encoded body.
+	ResponseBodyDecoding bool
+
+	// RequestMeter, if set, is called with each request and its captured
+	// response body to count the tokens it consumed, e.g. for LLM-serving APIs,
+	// which are logged as "inputTokens" and "outputTokens". Response bodies are
+	// always captured when it's set, but only up to BodyCaptureLimit bytes.
+	RequestMeter func(r *http.Request, respBody []byte) (inputTokens, outputTokens int)
+
+	// CircuitBreakerStatus, if set, returns the state of the circuit breaker
+	// the request went through, like "closed", "open" or "half-open", once the
+	// handler returns. It's logged as "circuitBreakerState" unless empty.
+	CircuitBreakerStatus func(r *http.Request) string
+
+	// FeatureFlagLogger, if set, returns the feature flags evaluated for the
+	// request, from its context once the handler returns. They're logged as the
+	// "featureFlags" object in "httpRequest", unless there are none.
+	FeatureFlagLogger func(ctx context.Context) map[string]bool
+
+	// ContentNegotiationLogging logs the Accept header of requests as
+	// "acceptHeader" and the Content-Type of responses as
+	// "responseContentType", and "contentNegotiationMismatch" when the latter
+	// isn't one the former allows.
+	ContentNegotiationLogging bool
+
+	// MiddlewareID, if set, is logged as "middlewareID" at the top level of
+	// every log line.
+	MiddlewareID string
+
+	// SensitiveHeaderFn, if set, reports whether the header with the given
+	// lowercase name must be redacted, instead of DefaultSensitiveHeaderFn.
+	SensitiveHeaderFn func(key string) bool
+
+	// AlwaysLogScheme logs "scheme" in "httpRequest" even when Concise is set.
+	AlwaysLogScheme bool
+
+	// GCPTraceProjectID, when set, parses the X-Cloud-Trace-Context request
+	// header and logs the top-level "logging.googleapis.com/trace" (as
+	// "projects/<GCPTraceProjectID>/traces/<traceID>") and
+	// "logging.googleapis.com/spanId" fields, which Google Cloud Logging uses to
+	// correlate log entries with their traces.
+	GCPTraceProjectID string
+
+	// RequestHeadersKey and ResponseHeadersKey, if set, replace "header" as the
+	// name of the object the headers are logged as in "httpRequest" and
+	// "httpResponse" respectively, e.g. "headers" to match an existing schema.
+	RequestHeadersKey  string
+	ResponseHeadersKey string
+
+	// MaxRequestReadBytes limits how much of the request body the middleware
+	// itself reads, for signature verification and JSON request body logging,
+	// independently of any limit on the handler. It defaults to 1 MiB. When a
+	// body is longer, it isn't verified or logged, and "requestBodyTruncated" is
+	// logged instead. The handler can still read the body in full.
+	MaxRequestReadBytes int64
+
+	// VerboseHeader, when set, is a request header that enables verbose logging
+	// for the request when its value is VerboseHeaderSecret: Concise is turned
+	// off, response bodies are logged regardless of status, and all optional
+	// fields that don't need further configuration are logged. The header's value
+	// is always redacted.
+	VerboseHeader       string
+	VerboseHeaderSecret string
+
+	// ResponseBodySizeField logs the number of bytes of the response body written
+	// by the handler as "responseSizeBytes", which unlike the logged body is
+	// never truncated. It's enabled by default. The same value is also logged
+	// as "bytes", which is deprecated and will be removed in favor of
+	// "responseSizeBytes".
+	ResponseBodySizeField bool
+
+	// ContextLogFields are request context values that are logged in
+	// "httpResponse" when they're set. They're looked up once the handler
+	// returns, in the context the middleware passed to it, so they must be set by
+	// middleware that runs earlier, or be mutable values updated by the handler.
+	ContextLogFields []ContextLogField
+
+	// ResponseBodyHash, if set, logs the hex-encoded hash of the captured
+	// response body as "responseBodyHash", so the body can be checked for
+	// tampering or truncation by the log pipeline. The hash function must be
+	// linked into the binary.
+	ResponseBodyHash crypto.Hash
+
+	// RequestStartTime logs the time the middleware received the request as
+	// "requestReceivedAt", e.g. to correlate requests with external events. The
+	// time the log line was written is already logged by zap.
+	RequestStartTime bool
+
+	// OTelBaggageKeys are the keys of OpenTelemetry baggage members, propagated
+	// in the request context from upstream services, to log in the "baggage"
+	// object. Other members are ignored.
+	OTelBaggageKeys []string
+
+	// MaskedPathSegments are patterns matching sensitive parts of request paths,
+	// like email addresses, which are replaced with "<redacted>" wherever the
+	// path is logged, including "requestURL" and the log message.
+	MaskedPathSegments []*regexp.Regexp
+
+	// MetricsTagExtractor, if set, returns the dimensions to record metrics for
+	// a request under, like {"endpoint": "GetUser"}, which are logged as the
+	// "metricsTags" object so logs and metrics can be correlated. It's called
+	// once per request, after the handler returns, so chi route patterns are
+	// available. The middleware doesn't record metrics itself; to record them
+	// under the same tags, call the extractor from the metrics middleware too.
+	MetricsTagExtractor func(*http.Request) map[string]string
+
+	// CaptureBodyAlways captures the response body regardless of the status, so
+	// that features like ResponseBodyHash apply to every response. Whether the
+	// body itself is logged is still determined by ResponseBodyConditions and
+	// CaptureBodyCodes.
+	CaptureBodyAlways bool
+
+	// RequiredSecurityHeaders are response headers, like X-Content-Type-Options
+	// or Content-Security-Policy, that every response should have. Any that are
+	// missing are logged as "missingSecurityHeaders", and the line is logged at
+	// least at Warn level.
+	RequiredSecurityHeaders []string
+
+	// RequiredRequestHeaders are request headers, like X-API-Version, that
+	// clients are expected to send. Any that are missing are logged as
+	// "missingRequestHeaders", and the line is logged at least at Warn level.
+	// Requests missing them are still handled.
+	RequiredRequestHeaders []string
+
+	// GRPCTrailerFields are response trailers, like grpc-status-details-bin or
+	// server timing trailers, whose values are logged in the "trailers" object
+	// once the handler returns.
+	GRPCTrailerFields []string
+
+	// DeclareTrailerKeys are trailers that are declared in the Trailer response
+	// header before the handler runs.
+	DeclareTrailerKeys []string
+
+	// ConcurrencyLimit, if set, is a semaphore that a slot is acquired from
+	// before calling the handler, and released once the request is logged. The
+	// time spent waiting for a slot is logged as "queueWaitDuration". If the
+	// request context is done first, the handler isn't called, a 503 Service
+	// Unavailable response is written, and "queueAbandoned" is logged.
+	ConcurrencyLimit chan struct{}
+
+	// CDNCacheStatusHeader, when set, is a response header with the cache status
+	// of a CDN, like Cloudflare's CF-Cache-Status or X-Cache, which is logged as
+	// "cdnCacheStatus", along with "cdnCacheHit" when it's one of
+	// CDNCacheHitValues (ignoring case). When CDNCacheHitValues is empty,
+	// "HIT", "STALE", "UPDATING" and "REVALIDATED" are hits.
+	CDNCacheStatusHeader string
+	CDNCacheHitValues    []string
+
+	// ServerTiming adds the time until the response header was written to the
+	// Server-Timing response header as "ttfb", so browsers can show it, and logs
+	// it as "serverTimingTTFB" along with the total time taken by the handler as
+	// "serverTimingTotal". The total is only known after the header is sent, so
+	// it's only added to the header when the handler didn't write a response.
+	ServerTiming bool
+
+	// ActualRequestBodySize logs the number of bytes of the request body read by
+	// the handler as "requestBodyBytesRead", which unlike Content-Length is also
+	// known for chunked requests. When it differs from a known Content-Length,
+	// e.g. because the handler didn't read the whole body, "contentLengthMismatch"
+	// is logged too.
+	ActualRequestBodySize bool
+
+	// ContextErrorDetail logs why the request context was done, if it was by
+	// the time the handler returned, as "contextError", the context's cause,
+	// and "contextErrorKind", either "deadline" or "cancelled".
+	ContextErrorDetail bool
+
+	// TimeZone, if set, is the time zone times logged by the middleware, like
+	// "requestReceivedAt" and "contextDeadline" and the access log time, are
+	// shown in. Times are then logged as RFC 3339 strings rather than formatted
+	// by the encoder. The timestamp of the log line itself is up to zap.
+	TimeZone *time.Location
+
+	// ElasticCommonSchema logs requests with the field names of the Elastic
+	// Common Schema (ECS), e.g. "http.request.method" and "url.path", as nested
+	// objects, instead of "httpRequest" and "httpResponse". Fields without an
+	// ECS equivalent are logged in "http.request" and "http.response" under their
+	// usual names. FieldNameMapper doesn't apply to ECS fields.
+	ElasticCommonSchema bool
+
+	// RequestSignature, if set, returns an opaque fingerprint of the request,
+	// logged as "requestSignature", to group similar requests. Unlike
+	// PathNormalizer, it doesn't change the logged path.
+	RequestSignature func(r *http.Request) string
+
+	// GRPCWebLogging logs the status code name and message of gRPC-Web
+	// responses as "grpcStatus" and "grpcMessage", like GRPCStatusLogging does
+	// for gRPC. gRPC-Web sends them in a trailer frame at the end of the response
+	// body, which is decoded as it's written. Only binary gRPC-Web is supported,
+	// not application/grpc-web-text.
+	GRPCWebLogging bool
+
+	// AWSRequestID logs the X-Amzn-RequestId header set by API Gateway and the
+	// X-Amzn-Trace-Id header set by Lambda and load balancers as "awsRequestId"
+	// and "awsTraceId". "remoteIP" is still the request's RemoteAddr; to log the
+	// client IP from X-Forwarded-For, use chi's middleware.RealIP before the
+	// logging middleware.
+	AWSRequestID bool
+
+	// GeolocationDB, if set, is used to look up the country of the request's
+	// remote IP, logged as "countryCode". Lookup errors are ignored.
+	GeolocationDB GeolocationDB
+
+	// SSELogging counts the events written to Server-Sent Events
+	// (text/event-stream) responses, logging "sseEventCount" and "sseDuration"
+	// once the stream is closed. While the stream is open, a line is written at
+	// Debug level after each event, with an "event" field of "sseEvent", to the
+	// logger and ExtraLoggers alike.
+	SSELogging bool
+
+	// CORSPreflightLevel, if set, is the level OPTIONS requests answered with a
+	// 204 No Content, i.e. CORS preflight requests, are logged at. Setting it to
+	// Debug hides them in most production configurations. Levels set with
+	// SetRouteLogLevel take precedence.
+	CORSPreflightLevel *zapcore.Level
+
+	// HTTPSRedirectLogging logs "httpsUpgradeRedirect" for 301 and 302 responses
+	// to plain HTTP requests that redirect to an https:// URL, to audit HTTPS
+	// enforcement.
+	HTTPSRedirectLogging bool
+
+	// PathParamExtractor, if set, returns the path parameters of the request
+	// for routers other than chi, logged as the "pathParams" object. Values for
+	// which URLParamRedactor returns true are redacted.
+	PathParamExtractor func(r *http.Request) map[string]string
+
+	// AccessTokenPrefix, if positive, is the number of characters of bearer
+	// tokens in the Authorization header to log, instead of redacting the
+	// header entirely.
+	AccessTokenPrefix int
+}
+
+func (o *Options) Clone() *Options {
+	if o == nil {
+		return nil
+	}
+
+	return &Options{
+		Concise:                       o.Concise,
+		SkipHeaders:                   copySlice(o.SkipHeaders),
+		IngressHeaders:                o.IngressHeaders,
+		DefaultFields:                 copySlice(o.DefaultFields),
+		ErrorResponseParser:           o.ErrorResponseParser,
+		WebhookSignatureHeader:        o.WebhookSignatureHeader,
+		WebhookSignatureHash:          o.WebhookSignatureHash,
+		WebhookSecret:                 copySlice(o.WebhookSecret),
+		PreLogHook:                    o.PreLogHook,
+		PostLogHook:                   o.PostLogHook,
+		H2PushLogging:                 o.H2PushLogging,
+		TenantLogger:                  o.TenantLogger,
+		BodyContentTypeAllowList:      copySlice(o.BodyContentTypeAllowList),
+		LogRequestStart:               o.LogRequestStart,
+		RequestLogLevel:               o.RequestLogLevel,
+		PathNormalizer:                o.PathNormalizer,
+		BodyLogFormat:                 o.BodyLogFormat,
+		LogCookieNames:                o.LogCookieNames,
+		GRPCStatusLogging:             o.GRPCStatusLogging,
+		OpenAPIOperationID:            o.OpenAPIOperationID,
+		StructuredQueryParams:         o.StructuredQueryParams,
+		QueryParamRedactKeys:          copySlice(o.QueryParamRedactKeys),
+		AccessLogWriter:               o.AccessLogWriter,
+		ReqIDGenerator:                o.ReqIDGenerator,
+		JSONRequestBodyMaxBytes:       o.JSONRequestBodyMaxBytes,
+		JSONRequestBodyRedactFields:   copySlice(o.JSONRequestBodyRedactFields),
+		PerformanceProfile:            o.PerformanceProfile,
+		BodyIntegrityHeader:           o.BodyIntegrityHeader,
+		BodyIntegrityKey:              copySlice(o.BodyIntegrityKey),
+		ClientCertLogging:             o.ClientCertLogging,
+		RequestCountHeader:            o.RequestCountHeader,
+		ExtraLoggers:                  copySlice(o.ExtraLoggers),
+		ContextDeadlineLogging:        o.ContextDeadlineLogging,
+		ResponseBodyConditions:        copySlice(o.ResponseBodyConditions),
+		CaptureBodyCodes:              copyMap(o.CaptureBodyCodes),
+		FieldNameMapper:               o.FieldNameMapper,
+		Environment:                   o.Environment,
+		EnvironmentSuppressedFields:   copyMap(o.EnvironmentSuppressedFields),
+		VerboseOnlyFields:             o.VerboseOnlyFields,
+		StatusCodeTranslations:        copyMap(o.StatusCodeTranslations),
+		TeeWriter:                     o.TeeWriter,
+		DurationBudgetFunc:            o.DurationBudgetFunc,
+		ChiURLParams:                  o.ChiURLParams,
+		URLParamRedactor:              o.URLParamRedactor,
+		ElideDuplicateFields:          o.ElideDuplicateFields,
+		LogID:                         o.LogID,
+		ErrorRateWindow:               o.ErrorRateWindow,
+		ErrorRateBuckets:              o.ErrorRateBuckets,
+		DefaultStatus:                 o.DefaultStatus,
+		RangeRequestLogging:           o.RangeRequestLogging,
+		RequestBodyPreview:            o.RequestBodyPreview,
+		ServerContext:                 o.ServerContext,
+		BodyCaptureMaxAge:             o.BodyCaptureMaxAge,
+		ErrorBodyMinSize:              o.ErrorBodyMinSize,
+		BodyCaptureLimit:              o.BodyCaptureLimit,
+		IncidentBodyCaptureLimit:      o.IncidentBodyCaptureLimit,
+		IncidentErrorThreshold:        o.IncidentErrorThreshold,
+		IncidentWindow:                o.IncidentWindow,
+		EchoCorrelationRequestHeader:  o.EchoCorrelationRequestHeader,
+		EchoCorrelationResponseHeader: o.EchoCorrelationResponseHeader,
+		RetryAfterLogging:             o.RetryAfterLogging,
+		BotPatterns:                   copySlice(o.BotPatterns),
+		DeprecationRegistry:           o.DeprecationRegistry,
+		LatencyTracker:                o.LatencyTracker,
+		ConcurrentRequestGauge:        o.ConcurrentRequestGauge,
+		ResponseBodyDecoding:          o.ResponseBodyDecoding,
+		RequestMeter:                  o.RequestMeter,
+		CircuitBreakerStatus:          o.CircuitBreakerStatus,
+		FeatureFlagLogger:             o.FeatureFlagLogger,
+		ContentNegotiationLogging:     o.ContentNegotiationLogging,
+		MiddlewareID:                  o.MiddlewareID,
+		SensitiveHeaderFn:             o.SensitiveHeaderFn,
+		AlwaysLogScheme:               o.AlwaysLogScheme,
+		GCPTraceProjectID:             o.GCPTraceProjectID,
+		RequestHeadersKey:             o.RequestHeadersKey,
+		ResponseHeadersKey:            o.ResponseHeadersKey,
+		MaxRequestReadBytes:           o.MaxRequestReadBytes,
+		VerboseHeader:                 o.VerboseHeader,
+		VerboseHeaderSecret:           o.VerboseHeaderSecret,
+		ResponseBodySizeField:         o.ResponseBodySizeField,
+		ContextLogFields:              copySlice(o.ContextLogFields),
+		ResponseBodyHash:              o.ResponseBodyHash,
+		RequestStartTime:              o.RequestStartTime,
+		OTelBaggageKeys:               copySlice(o.OTelBaggageKeys),
+		MaskedPathSegments:            copySlice(o.MaskedPathSegments),
+		MetricsTagExtractor:           o.MetricsTagExtractor,
+		CaptureBodyAlways:             o.CaptureBodyAlways,
+		RequiredSecurityHeaders:       copySlice(o.RequiredSecurityHeaders),
+		RequiredRequestHeaders:        copySlice(o.RequiredRequestHeaders),
+		GRPCTrailerFields:             copySlice(o.GRPCTrailerFields),
+		DeclareTrailerKeys:            copySlice(o.DeclareTrailerKeys),
+		ConcurrencyLimit:              o.ConcurrencyLimit,
+		CDNCacheStatusHeader:          o.CDNCacheStatusHeader,
+		CDNCacheHitValues:             copySlice(o.CDNCacheHitValues),
+		ServerTiming:                  o.ServerTiming,
+		ActualRequestBodySize:         o.ActualRequestBodySize,
+		ContextErrorDetail:            o.ContextErrorDetail,
+		TimeZone:                      o.TimeZone,
+		ElasticCommonSchema:           o.ElasticCommonSchema,
+		RequestSignature:              o.RequestSignature,
+		GRPCWebLogging:                o.GRPCWebLogging,
+		AWSRequestID:                  o.AWSRequestID,
+		GeolocationDB:                 o.GeolocationDB,
+		SSELogging:                    o.SSELogging,
+		CORSPreflightLevel:            o.CORSPreflightLevel,
+		HTTPSRedirectLogging:          o.HTTPSRedirectLogging,
+		PathParamExtractor:            o.PathParamExtractor,
+		AccessTokenPrefix:             o.AccessTokenPrefix,
+	}
+}
+
+// captureBody returns whether the body of a response with the given status
+// should be captured and logged.
+func (o *Options) captureBody(status int) bool {
+	if len(o.ResponseBodyConditions) == 0 && len(o.CaptureBodyCodes) == 0 {
+		return status >= 400
+	}
+	if _, ok := o.CaptureBodyCodes[status]; ok {
+		return true
+	}
+	for _, cond := range o.ResponseBodyConditions {
+		if cond(status) {
+			return true
+		}
+	}
+	return false
+}
+
+// isVerbose returns whether r enables verbose logging with VerboseHeader.
+func (o *Options) isVerbose(r *http.Request) bool {
+	if o.VerboseHeader == "" || o.VerboseHeaderSecret == "" {
+		return false
+	}
+	got := r.Header.Get(o.VerboseHeader)
+	return subtle.ConstantTimeCompare([]byte(got), []byte(o.VerboseHeaderSecret)) == 1
+}
+
+// verbose returns a copy of the options with verbose logging enabled, for
+// requests that satisfy isVerbose.
+func (o *Options) verbose() *Options {
+	v := o.Clone()
+	v.Concise = false
+	v.ResponseBodyConditions = []func(int) bool{func(int) bool { return true }}
+	v.H2PushLogging = true
+	v.LogCookieNames = true
+	v.GRPCStatusLogging = true
+	v.StructuredQueryParams = true
+	v.ClientCertLogging = true
+	v.ContextDeadlineLogging = true
+	v.ChiURLParams = true
+	v.RangeRequestLogging = true
+	return v
+}
+
+// captureBodyBuffer returns whether the body of a response with the given
+// status should be buffered, which is the case for all responses if
+// CaptureBodyAlways or RequestMeter is set, even if their body won't be logged.
+func (o *Options) captureBodyBuffer(status int) bool {
+	return o.CaptureBodyAlways || o.RequestMeter != nil || o.captureBody(status)
+}
+
+// suppressed reports whether the field with the given name is to be left out of
+// the log lines in the current Environment.
+func (o *Options) suppressed(name string) bool {
+	for _, f := range o.EnvironmentSuppressedFields[o.Environment] {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldNameMapper returns the mapper for the names of the fields of the
+// "httpRequest" and "httpResponse" objects, which drops suppressed fields
+// before applying FieldNameMapper, or nil if names are left as-is.
+func (o *Options) fieldNameMapper() func(string) string {
+	if len(o.EnvironmentSuppressedFields[o.Environment]) == 0 {
+		return o.FieldNameMapper
+	}
+	return func(name string) string {
+		if o.suppressed(name) {
+			return ""
+		}
+		if o.FieldNameMapper != nil {
+			return o.FieldNameMapper(name)
+		}
+		return name
+	}
+}
+
+// bodyCaptureLimit returns the maximum number of bytes of a response body to
+// capture, which is raised during incidents, as counted by incidents.
+func (o *Options) bodyCaptureLimit(incidents *errorRateTracker) int {
+	if o.IncidentBodyCaptureLimit > 0 && incidents != nil && incidents.errorCount(time.Now()) > o.IncidentErrorThreshold {
+		return o.IncidentBodyCaptureLimit
+	}
+	if o.BodyCaptureLimit > 0 {
+		return o.BodyCaptureLimit
+	}
+	return defaultBodyCaptureLimit
+}
+
+// inTimeZone returns t in TimeZone, if it's set.
+func (o *Options) inTimeZone(t time.Time) time.Time {
+	if o.TimeZone == nil {
+		return t
+	}
+	return t.In(o.TimeZone)
+}
+
+// addTime adds t to enc, formatted by the encoder, or as an RFC 3339 string in
+// TimeZone if it's set.
+func (o *Options) addTime(enc zapcore.ObjectEncoder, key string, t time.Time) {
+	if o.TimeZone == nil {
+		enc.AddTime(key, t)
+		return
+	}
+	enc.AddString(key, t.In(o.TimeZone).Format(time.RFC3339Nano))
+}
+
+// maskPath replaces the parts of path matching MaskedPathSegments.
+func (o *Options) maskPath(path string) string {
+	for _, re := range o.MaskedPathSegments {
+		path = re.ReplaceAllString(path, "<redacted>")
+	}
+	return path
+}
+
+// maskRequestURI masks the path of a request URI like maskPath, and redacts
+// the values of the query parameters in QueryParamRedactKeys.
+func (o *Options) maskRequestURI(requestURI string) string {
+	requestURI = o.maskPath(requestURI)
+	if len(o.QueryParamRedactKeys) == 0 {
+		return requestURI
+	}
+	path, query, ok := strings.Cut(requestURI, "?")
+	if !ok {
+		return requestURI
+	}
+	return path + "?" + redactQuery(query, o.QueryParamRedactKeys)
+}
+
+// withDefaultFields adds the default fields, and the middleware ID, to logger,
+// leaving out those it already has if ElideDuplicateFields is set.
+func (o *Options) withDefaultFields(logger *zap.Logger) *zap.Logger {
+	fields := o.DefaultFields
+	if o.MiddlewareID != "" {
+		fields = append(copySlice(fields), zap.String("middlewareID", o.MiddlewareID))
+	}
+	if o.ElideDuplicateFields {
+		return logger.With(elideDuplicateFields(logger, fields)...)
+	}
+	return logger.With(fields...)
+}
+
+func copySlice[T any](in []T) []T {
+	if in == nil {
+		return nil
+	}
+
+	out := make([]T, len(in))
+	copy(out, in)
+	return out
+}
+
+func copyMap[K comparable, V any](in map[K]V) map[K]V {
+	if in == nil {
+		return nil
+	}
+
+	out := make(map[K]V, len(in))
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
+
+// NewMiddleware returns middleware that writes a structured log line for each
+// request once the handler returns. The log entry is held by the middleware
+// itself rather than looked up from the request context, so the line is still
+// written, with all response fields, when the request context was cancelled
+// (e.g. because the client disconnected).
+func NewMiddleware(logger *zap.Logger, options ...Option) Middleware {
+	opts := newOptions(options)
+	opts.warnConflicts(logger)
+	return newMiddleware(logger, opts)
+}
+
+// NewMiddlewareE is like NewMiddleware, but returns an error if any of the
+// options conflict (see OptionConflict) instead of logging a warning.
+func NewMiddlewareE(logger *zap.Logger, options ...Option) (Middleware, error) {
+	opts := newOptions(options)
+	if conflicts := opts.conflicts(); len(conflicts) > 0 {
+		errs := make([]error, len(conflicts))
+		for i, c := range conflicts {
+			errs[i] = c
+		}
+		return nil, errors.Join(errs...)
+	}
+	return newMiddleware(logger, opts), nil
+}
+
+// warnConflicts logs a warning listing the conflicting options, if any.
+func (o *Options) warnConflicts(logger *zap.Logger) {
+	conflicts := o.conflicts()
+	if len(conflicts) == 0 {
+		return
+	}
+	msgs := make([]string, len(conflicts))
+	for i, c := range conflicts {
+		msgs[i] = c.Error()
+	}
+	logger.Warn("conflicting zaphttplog options", zap.Strings("conflicts", msgs))
+}
+
+// newOptions returns the default options with the given options applied.
+func newOptions(options []Option) *Options {
+	opts := defaultOptions.Clone()
+	for _, o := range options {
+		o(opts)
+	}
+	return opts
+}
+
+func newMiddleware(logger *zap.Logger, opts *Options) Middleware {
+	baseLogger := opts.withDefaultFields(logger)
+	extraLoggers := make([]*zap.Logger, len(opts.ExtraLoggers))
+	for i, extraLogger := range opts.ExtraLoggers {
+		extraLoggers[i] = opts.withDefaultFields(extraLogger)
+	}
+	connCounts := newConnCounter()
+	var logSeq atomic.Uint64
+	var inFlight atomic.Int64
+	var errorRate *errorRateTracker
+	if opts.ErrorRateWindow > 0 {
+		errorRate = newErrorRateTracker(opts.ErrorRateWindow, opts.ErrorRateBuckets)
+	}
+	var incidents *errorRateTracker
+	if opts.IncidentWindow > 0 {
+		incidents = newErrorRateTracker(opts.IncidentWindow, incidentBuckets)
+	}
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			received := time.Now()
+			opts := opts
+			if opts.isVerbose(r) {
+				opts = opts.verbose()
+			}
+
+			logger := baseLogger
+			if opts.TenantLogger != nil {
+				if tl := opts.TenantLogger(r); tl != nil {
+					logger = opts.withDefaultFields(tl)
+				}
+			}
+
+			ctx, levels := withLogLevelState(r.Context())
+			if opts.ReqIDGenerator != nil && middleware.GetReqID(ctx) == "" && GetRequestID(ctx) == "" {
+				ctx = SetRequestID(ctx, opts.ReqIDGenerator(r))
+			}
+			if opts.EchoCorrelationRequestHeader != "" {
+				if id := r.Header.Get(opts.EchoCorrelationRequestHeader); id != "" {
+					w.Header().Set(opts.EchoCorrelationResponseHeader, id)
+					if GetCorrelationID(ctx) == "" {
+						ctx = context.WithValue(ctx, correlationIDKey, id)
+					}
+				}
+			}
+			r = r.WithContext(ctx)
+
+			entry := &requestLoggerEntry{
+				logger:       logger,
+				extraLoggers: copySlice(extraLoggers),
+				opts:         opts,
+				req:          r,
+				levels:       levels,
+				errorRate:    errorRate,
+			}
+			if opts.LogID {
+				entry.logSeq = logSeq.Add(1)
+			}
+			if opts.RequestStartTime {
+				entry.reqFields = append(entry.reqFields, func(enc zapcore.ObjectEncoder) error { opts.addTime(enc, "requestReceivedAt", received); return nil })
+			}
+			if opts.ConcurrentRequestGauge {
+				before := inFlight.Add(1) - 1
+				entry.reqFields = append(entry.reqFields, func(enc zapcore.ObjectEncoder) error { enc.AddInt64("inFlightBefore", before); return nil })
+			}
+
+			// bodyTruncated is set when the body was longer than MaxRequestReadBytes.
+			var bodyTruncated bool
+			if opts.WebhookSignatureHeader != "" {
+				valid, truncated := verifyBodySignature(r, opts.WebhookSignatureHeader, opts.WebhookSignatureHash, opts.WebhookSecret, opts.MaxRequestReadBytes)
+				bodyTruncated = bodyTruncated || truncated
+				entry.reqFields = append(entry.reqFields, func(enc zapcore.ObjectEncoder) error { enc.AddBool("webhookSignatureValid", valid); return nil })
+				if !valid {
+					entry.raiseLevel(zapcore.WarnLevel)
+				}
+			}
+
+			if opts.BodyIntegrityHeader != "" {
+				valid, truncated := verifyBodySignature(r, opts.BodyIntegrityHeader, crypto.SHA256, opts.BodyIntegrityKey, opts.MaxRequestReadBytes)
+				bodyTruncated = bodyTruncated || truncated
+				entry.reqFields = append(entry.reqFields, func(enc zapcore.ObjectEncoder) error { enc.AddBool("bodyIntegrityValid", valid); return nil })
+				if !valid {
+					entry.raiseLevel(zapcore.WarnLevel)
+				}
+			}
+
+			if opts.JSONRequestBodyMaxBytes > 0 && isJSONContentType(r.Header.Get("Content-Type")) {
+				var body []byte
+				if opts.MaxRequestReadBytes > 0 && opts.MaxRequestReadBytes < int64(opts.JSONRequestBodyMaxBytes) {
+					var truncated bool
+					body, truncated, _ = readRequestBody(r, opts.MaxRequestReadBytes)
+					bodyTruncated = bodyTruncated || truncated
+				} else {
+					body = peekRequestBody(r, opts.JSONRequestBodyMaxBytes)
+				}
+				if body, ok := parseJSONRequestBody(body, opts.JSONRequestBodyRedactFields); ok && !bodyTruncated {
+					entry.reqFields = append(entry.reqFields, func(enc zapcore.ObjectEncoder) error { return enc.AddReflected("requestBody", body) })
+				}
+			} else if opts.RequestBodyPreview > 0 && r.Body != nil && r.Body != http.NoBody {
+				preview := limitBuffer{Buffer: new(bytes.Buffer), limit: opts.RequestBodyPreview}
+				r.Body = readCloser{Reader: io.TeeReader(r.Body, preview), Closer: r.Body}
+				entry.reqFields = append(entry.reqFields, func(enc zapcore.ObjectEncoder) error {
+					if preview.Len() > 0 {
+						enc.AddString("requestBodyPreview", preview.String())
+					}
+					return nil
+				})
+			}
+			if bodyTruncated {
+				entry.reqFields = append(entry.reqFields, func(enc zapcore.ObjectEncoder) error { enc.AddBool("requestBodyTruncated", true); return nil })
+			}
+
+			if opts.ActualRequestBodySize {
+				// The body is wrapped after the middleware's own reads above, which
+				// leave it to be read in full, so only the handler's reads count.
+				var counter *countingReadCloser
+				if r.Body != nil && r.Body != http.NoBody {
+					counter = &countingReadCloser{ReadCloser: r.Body}
+					r.Body = counter
+				}
+				contentLength := r.ContentLength
+				entry.reqFields = append(entry.reqFields, func(enc zapcore.ObjectEncoder) error {
+					var n int64
+					if counter != nil {
+						n = counter.n
+					}
+					enc.AddInt64("requestBodyBytesRead", n)
+					if contentLength >= 0 && n != contentLength {
+						enc.AddBool("contentLengthMismatch", true)
+					}
+					return nil
+				})
+			}
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			if pusher, ok := ww.(http.Pusher); opts.H2PushLogging && ok {
+				pw := &pushRecorder{WrapResponseWriter: ww, pusher: pusher}
+				entry.respFields = append(entry.respFields, func(enc zapcore.ObjectEncoder) error {
+					if len(pw.targets) == 0 {
+						return nil
+					}
+					return enc.AddArray("pushedResources", stringsMarshaler(pw.targets))
+				})
+				ww = pw
+			}
+
+			var stw *serverTimingWriter
+			if opts.ServerTiming {
+				stw = &serverTimingWriter{WrapResponseWriter: ww}
+				ww = stw.withOptionalInterfaces()
+			}
+
+			if len(opts.DeclareTrailerKeys) > 0 {
+				ww.Header().Set("Trailer", strings.Join(opts.DeclareTrailerKeys, ", "))
+			}
+
+			var missingHeaders []string
+			for _, h := range opts.RequiredRequestHeaders {
+				if r.Header.Get(h) == "" {
+					missingHeaders = append(missingHeaders, h)
+				}
+			}
+			if len(missingHeaders) > 0 {
+				entry.reqFields = append(entry.reqFields, func(enc zapcore.ObjectEncoder) error {
+					return enc.AddArray("missingRequestHeaders", stringsMarshaler(missingHeaders))
+				})
+				entry.raiseLevel(zapcore.WarnLevel)
+			}
+
+			if opts.RequestCountHeader != "" {
+				count := connCounts.inc(r.RemoteAddr)
+				ww.Header().Set(opts.RequestCountHeader, strconv.FormatInt(count, 10))
+				entry.reqFields = append(entry.reqFields, func(enc zapcore.ObjectEncoder) error { enc.AddInt64("connRequestCount", count); return nil })
+			}
+
+			buf := &bodyCapture{
+				status:  ww.Status,
+				capture: opts.captureBodyBuffer,
+				limit:   opts.bodyCaptureLimit(incidents),
+			}
+			// The response writer only supports a single tee'd writer.
+			tees := []io.Writer{buf}
+			if opts.TeeWriter != nil {
+				tees = append(tees, opts.TeeWriter)
+			}
+			if opts.GRPCWebLogging && isGRPCWeb(r.Header.Get("Content-Type")) {
+				entry.grpcWeb = &grpcWebTrailerReader{}
+				tees = append(tees, entry.grpcWeb)
+			}
+			if opts.SSELogging {
+				header := ww.Header()
+				// The request field is built on the first event, once the
+				// handler has started writing, and reused for the rest.
+				var reqField *zap.Field
+				entry.sse = &sseEventCounter{onEvent: func(count int) {
+					if !isEventStream(header) {
+						return
+					}
+					if reqField == nil {
+						f := requestLogField(r, opts, entry.reqFields)
+						reqField = &f
+					}
+					eventFields := []zap.Field{*reqField, zap.String("event", "sseEvent"), zap.Int("sseEventCount", count)}
+					logger.Debug(entry.message(), eventFields...)
+					for _, extraLogger := range extraLoggers {
+						extraLogger.Debug(entry.message(), eventFields...)
+					}
+				}}
+				tees = append(tees, entry.sse)
+			}
+			if len(tees) == 1 {
+				ww.Tee(buf)
+			} else {
+				ww.Tee(io.MultiWriter(tees...))
+			}
+
+			if opts.LogRequestStart {
+				startFields := []zap.Field{requestLogField(r, opts, entry.reqFields), zap.String("event", "incoming")}
+				if opts.ElasticCommonSchema {
+					startFields = ecsFields(r, opts, entry.reqFields, nil)
+				}
+				levelFunc(logger, opts.RequestLogLevel)(entry.message(), startFields...)
+				for _, extraLogger := range extraLoggers {
+					levelFunc(extraLogger, opts.RequestLogLevel)(entry.message(), startFields...)
+				}
+			}
+
+			// queueAbandoned is set when the request context was done while waiting
+			// for a ConcurrencyLimit slot, in which case the handler isn't called.
+			var queueAbandoned bool
+			if opts.ConcurrencyLimit != nil {
+				waitStart := time.Now()
+				select {
+				case opts.ConcurrencyLimit <- struct{}{}:
+					defer func() { <-opts.ConcurrencyLimit }()
+				case <-r.Context().Done():
+					queueAbandoned = true
+					entry.reqFields = append(entry.reqFields, func(enc zapcore.ObjectEncoder) error { enc.AddBool("queueAbandoned", true); return nil })
+				}
+				wait := time.Since(waitStart)
+				entry.reqFields = append(entry.reqFields, func(enc zapcore.ObjectEncoder) error { enc.AddDuration("queueWaitDuration", wait); return nil })
+			}
+
+			// MemStats is large, so it's only allocated when needed.
+			var memBefore *runtime.MemStats
+			if opts.PerformanceProfile {
+				memBefore = new(runtime.MemStats)
+				runtime.ReadMemStats(memBefore)
+			}
+
+			t1 := time.Now()
+			if stw != nil {
+				stw.start = t1
+			}
+			defer func() {
+				if stw != nil {
+					entry.respFields = append(entry.respFields, stw.finish()...)
+				}
+				if memBefore != nil {
+					memAfter := new(runtime.MemStats)
+					runtime.ReadMemStats(memAfter)
+					entry.respFields = append(entry.respFields, perfStatsField(memBefore, memAfter))
+				}
+
+				if opts.ConcurrentRequestGauge {
+					after := inFlight.Add(-1)
+					entry.respFields = append(entry.respFields, func(enc zapcore.ObjectEncoder) error { enc.AddInt64("inFlightAfter", after); return nil })
+				}
+
+				elapsed := time.Since(t1)
+				var respBody []byte
+				if opts.BodyCaptureMaxAge > 0 && elapsed > opts.BodyCaptureMaxAge {
+					entry.bodySkipped = true
+				} else if bodyContentTypeAllowed(ww.Header().Get("Content-Type"), opts) {
+					respBody = buf.body()
+				}
+				entry.Write(ww.Status(), ww.BytesWritten(), ww.Header(), elapsed, respBody)
+				if incidents != nil {
+					incidents.record(time.Now(), ww.Status() >= 500)
+				}
+			}()
+
+			if queueAbandoned {
+				ww.WriteHeader(http.StatusServiceUnavailable)
+			} else {
+				next.ServeHTTP(ww, middleware.WithLogEntry(r, entry))
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// NewGroupMiddleware is like NewMiddleware, but adds a "routeGroup" field to
+// every log line. It's useful for labeling the routes of a mounted sub-router,
+// e.g. r.Mount("/api/v1", apiRouter) with a group of "api/v1".
+func NewGroupMiddleware(logger *zap.Logger, group string, options ...Option) Middleware {
+	options = append(copySlice(options), WithDefaultFields(zap.String("routeGroup", group)))
+	return NewMiddleware(logger, options...)
+}
+
+// CorrelationIDHeader is the header used by NewCorrelationMiddleware to receive
+// and propagate correlation IDs.
+const CorrelationIDHeader = "X-Correlation-ID"
+
+type contextKey int
+
+const (
+	correlationIDKey contextKey = iota
+	logLevelKey
+	requestIDKey
+	skipMetricsKey
+)
+
+// NewCorrelationMiddleware is like NewMiddleware, but also ensures each request
+// has a correlation ID, which is logged as "correlationID". The ID is taken from
+// the X-Correlation-ID request header, or generated if the header is absent,
+// and is echoed back in the X-Correlation-ID response header. Handlers can
+// retrieve it with GetCorrelationID to forward it on outgoing requests to other
+// services.
+func NewCorrelationMiddleware(logger *zap.Logger, options ...Option) Middleware {
+	mw := NewMiddleware(logger, options...)
+	return func(next http.Handler) http.Handler {
+		logged := mw(next)
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(CorrelationIDHeader)
+			if id == "" {
+				id = newCorrelationID()
+			}
+			w.Header().Set(CorrelationIDHeader, id)
+			logged.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), correlationIDKey, id)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// GetCorrelationID returns the correlation ID stored in the context by
+// NewCorrelationMiddleware, or an empty string if there isn't one.
+func GetCorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey).(string)
+	return id
+}
+
+// NewHealthCheckMiddleware is like NewMiddleware, but requests for any of the
+// given paths, like health check probes, are always logged at Debug level and
+// are marked in their context as requests that metrics should ignore (see
+// SkipMetrics), so they don't skew latency and request rate metrics.
+func NewHealthCheckMiddleware(logger *zap.Logger, paths []string, options ...Option) Middleware {
+	healthPaths := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		healthPaths[p] = true
+	}
+
+	mw := NewMiddleware(logger, options...)
+	return func(next http.Handler) http.Handler {
+		logged := mw(next)
+		loggedHealth := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			SetRouteLogLevel(r.Context(), zapcore.DebugLevel)
+			next.ServeHTTP(w, r)
+		}))
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if !healthPaths[r.URL.Path] {
+				logged.ServeHTTP(w, r)
+				return
+			}
+			loggedHealth.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), skipMetricsKey, true)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// SkipMetrics returns whether the request with the given context should be
+// excluded from metrics, because it's a health check handled by the
+// NewHealthCheckMiddleware.
+func SkipMetrics(ctx context.Context) bool {
+	skip, _ := ctx.Value(skipMetricsKey).(bool)
+	return skip
+}
+
+// SetRequestID returns a copy of ctx with the given request ID, which is logged
+// as "requestID" when the request wasn't assigned an ID by chi's
+// middleware.RequestID.
+func SetRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// GetRequestID returns the request ID stored in the context by SetRequestID or
+// by a generator configured with WithReqIDGenerator, or an empty string if
+// there isn't one. Use chi's middleware.GetReqID for IDs assigned by
+// middleware.RequestID.
+func GetRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestID returns the request ID assigned by chi's middleware.RequestID, or
+// else the one stored by SetRequestID, if any.
+func requestID(ctx context.Context) string {
+	if id := middleware.GetReqID(ctx); id != "" {
+		return id
+	}
+	return GetRequestID(ctx)
+}
+
+// LoggerFromContext returns the logger that NewMiddleware writes the log line
+// for the request with the given context to, or nil if the request isn't
+// handled by NewMiddleware.
+func LoggerFromContext(ctx context.Context) *zap.Logger {
+	entry, ok := ctx.Value(middleware.LogEntryCtxKey).(*requestLoggerEntry)
+	if !ok {
+		return nil
+	}
+	return entry.logger
+}
+
+func newCorrelationID() string {
+	var b [16]byte
+	// crypto/rand.Read doesn't fail in practice, and a zeroed ID is still usable.
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+type requestLoggerEntry struct {
+	logger *zap.Logger
+	// extraLoggers also receive every line written to logger.
+	extraLoggers []*zap.Logger
+	// msg replaces the default message prefix describing the request, e.g. when
+	// the handler panics.
+	msg  string
+	opts *Options
+
+	// req is the incoming request, used to build the "httpRequest" field when
+	// the log line is written.
+	req *http.Request
+	// reqFields and respFields are additional fields computed by the middleware
+	// to include in the "httpRequest" and "httpResponse" fields respectively.
+	reqFields  []objEncoderFn
+	respFields []objEncoderFn
+	// levels holds per-request adjustments to the level of the log line, and is
+	// also stored in the request context.
+	levels *logLevelState
+	// logSeq is the request's sequence number, or zero if LogID isn't set.
+	logSeq uint64
+	// errorRate is shared by all requests handled by the middleware, and is nil
+	// if ErrorRateWindow isn't set.
+	errorRate *errorRateTracker
+	// grpcWeb reads the trailers of gRPC-Web responses, and is nil unless
+	// GRPCWebLogging is set and the request is a gRPC-Web one.
+	grpcWeb *grpcWebTrailerReader
+	// sse counts the events of Server-Sent Events responses, and is nil unless
+	// SSELogging is set.
+	sse *sseEventCounter
+	// bodySkipped is set when the response body wasn't captured because the
+	// handler took longer than BodyCaptureMaxAge.
+	bodySkipped bool
+}
+
+// message returns the prefix of the log message, which describes the request
+// unless it's been replaced by msg.
+func (l *requestLoggerEntry) message() string {
+	if l.msg != "" || l.req == nil {
+		return l.msg
+	}
+	return fmt.Sprintf("%s %s", l.req.Method, requestPath(l.req, l.opts))
+}
+
+func (l *requestLoggerEntry) raiseLevel(lvl zapcore.Level) {
+	if lvl > l.levels.min {
+		l.levels.min = lvl
+	}
+}
+
+// logLevelState holds per-request adjustments to the level a request's log
+// line is written at.
+type logLevelState struct {
+	// override, if set, replaces the level derived from the response status.
+	override *zapcore.Level
+	// min is the lowest level the log line will be written at, even when
+	// override is set.
+	min zapcore.Level
+}
+
+func withLogLevelState(ctx context.Context) (context.Context, *logLevelState) {
+	s := &logLevelState{min: zapcore.DebugLevel}
+	return context.WithValue(ctx, logLevelKey, s), s
+}
+
+// SetRouteLogLevel overrides the level the current request will be logged at,
+// instead of the level derived from its response status. It can be called by
+// handlers or route-specific middleware running within the logging middleware,
+// and has no effect otherwise. Checks that raise the level of a request, like
+// invalid webhook signatures, still apply.
+func SetRouteLogLevel(ctx context.Context, lvl zapcore.Level) {
+	if s, ok := ctx.Value(logLevelKey).(*logLevelState); ok {
+		s.override = &lvl
+	}
+}
+
+func statusLabel(status int) string {
+	switch {
+	case status >= 100 && status < 300:
+		return "OK"
+	case status >= 300 && status < 400:
+		return "Redirect"
+	case status >= 400 && status < 500:
+		return "Client Error"
+	case status >= 500:
+		return "Server Error"
+	default:
+		return "Unknown"
+	}
+}
+
+func statusLevelWithContext(ctx context.Context, logger *zap.Logger, status int) func(string, ...zap.Field) {
+	lvl := statusLogLevel(status)
+	if s, ok := ctx.Value(logLevelKey).(*logLevelState); ok {
+		if s.override != nil {
+			lvl = *s.override
+		}
+		if s.min > lvl {
+			lvl = s.min
+		}
+	}
+	return levelFunc(logger, lvl)
+}
+
+func statusLogLevel(status int) zapcore.Level {
+	switch {
+	case status <= 0:
+		return zapcore.WarnLevel
+	case status < 400: // for codes in 100s, 200s, 300s
+		return zapcore.InfoLevel
+	case status >= 400 && status < 500:
+		return zapcore.WarnLevel
+	case status >= 500:
+		return zapcore.ErrorLevel
+	default:
+		return zapcore.InfoLevel
+	}
+}
+
+func levelFunc(logger *zap.Logger, lvl zapcore.Level) func(string, ...zap.Field) {
+	switch lvl {
+	case zapcore.DebugLevel:
+		return logger.Debug
+	case zapcore.InfoLevel:
+		return logger.Info
+	case zapcore.WarnLevel:
+		return logger.Warn
+	case zapcore.ErrorLevel:
+		return logger.Error
+	case zapcore.DPanicLevel:
+		return logger.DPanic
+	case zapcore.PanicLevel:
+		return logger.Panic
+	case zapcore.FatalLevel:
+		return logger.Fatal
+	default:
+		return logger.Info
+	}
+}
+
+type objEncoderFn func(enc zapcore.ObjectEncoder) error
+
+func headerLogField(header http.Header, opts *Options) []objEncoderFn {
+	var out []objEncoderFn
+	addStringField := func(k, v string) {
+		out = append(out, func(enc zapcore.ObjectEncoder) error { enc.AddString(k, v); return nil })
+	}
+	sensitive := opts.SensitiveHeaderFn
+	if sensitive == nil {
+		sensitive = DefaultSensitiveHeaderFn()
+	}
+	for k, v := range header {
+		k = strings.ToLower(k)
+		if sensitive(k) {
+			if k == "authorization" {
+				addStringField(k, redactAuthorization(v, opts.AccessTokenPrefix))
+			} else {
+				addStringField(k, "***")
+			}
+			if k == "cookie" && opts.LogCookieNames {
+				if names := cookieNames(v); len(names) > 0 {
+					out = append(out, func(enc zapcore.ObjectEncoder) error { return enc.AddArray("cookieNames", stringsMarshaler(names)) })
+				}
+			}
+			continue
+		}
+		if opts.VerboseHeader != "" && k == strings.ToLower(opts.VerboseHeader) || isSkippedHeader(k, opts.SkipHeaders) {
+			addStringField(k, "***")
+			continue
+		}
+		switch {
+		case len(v) == 0:
+			continue
+		case len(v) == 1:
+			addStringField(k, v[0])
+		default:
+			addStringField(k, fmt.Sprintf("[%s]", strings.Join(v, "], [")))
+		}
+	}
+	return out
+}
+
+// isSkippedHeader reports whether the header with the given lowercase name is
+// one of skipHeaders, which are redacted.
+func isSkippedHeader(k string, skipHeaders []string) bool {
+	for _, skip := range skipHeaders {
+		if strings.EqualFold(k, skip) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultSensitiveHeaderFn returns the function used to decide which headers to
+// redact when none is set with WithSensitiveHeaderFn, which matches the
+// Authorization, Cookie and Set-Cookie headers.
+func DefaultSensitiveHeaderFn() func(key string) bool {
+	return func(key string) bool {
+		return key == "authorization" || key == "cookie" || key == "set-cookie"
+	}
+}
+
+// redactAuthorization returns the value to log for the Authorization header,
+// which is redacted except for the first n characters of bearer tokens. Tokens
+// no longer than n are redacted entirely.
+func redactAuthorization(values []string, n int) string {
+	if n <= 0 || len(values) != 1 {
+		return "***"
+	}
+	const prefix = "bearer "
+	v := values[0]
+	if len(v) <= len(prefix) || strings.ToLower(v[:len(prefix)]) != prefix {
+		return "***"
+	}
+	token := v[len(prefix):]
+	if len(token) <= n {
+		return "***"
+	}
+	return v[:len(prefix)] + token[:n] + "..."
+}
+
+// retryAfterField returns the "retryAfterSecs" field for the given Retry-After
+// header value, which is either a number of seconds or an HTTP date, or the
+// "retryAfterRaw" field if it's neither. Dates in the past are logged as zero.
+func retryAfterField(v string, now time.Time) objEncoderFn {
+	var secs float64
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+		secs = float64(n)
+	} else if t, err := http.ParseTime(v); err == nil {
+		secs = math.Max(t.Sub(now).Seconds(), 0)
+	} else {
+		return func(enc zapcore.ObjectEncoder) error { enc.AddString("retryAfterRaw", v); return nil }
+	}
+	return func(enc zapcore.ObjectEncoder) error { enc.AddFloat64("retryAfterSecs", secs); return nil }
+}
+
+// headersKey returns key, or "header" if it's empty.
+func headersKey(key string) string {
+	if key == "" {
+		return "header"
+	}
+	return key
+}
+
+// cookieNames returns the names of the cookies in the given Cookie header values.
+func cookieNames(values []string) []string {
+	req := &http.Request{Header: http.Header{"Cookie": values}}
+	var names []string
+	for _, c := range req.Cookies() {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func (l *requestLoggerEntry) Write(status, byteCnt int, header http.Header, elapsed time.Duration, extra interface{}) {
+	var msg bytes.Buffer
+	if prefix := l.message(); prefix != "" {
+		msg.WriteString(prefix)
+		msg.WriteString(" - ")
+	}
+	// logStatus is only used to pick the label and level of the log line, the
+	// actual status is logged as-is.
+	logStatus := status
+	if status == 0 && l.opts.DefaultStatus != 0 {
+		logStatus = l.opts.DefaultStatus
+	}
+	if translated, ok := l.opts.StatusCodeTranslations[logStatus]; ok {
+		logStatus = translated
+	}
+	msg.WriteString(strconv.Itoa(status))
+	msg.WriteRune(' ')
+	msg.WriteString(statusLabel(logStatus))
+
+	if l.opts.CORSPreflightLevel != nil && l.levels.override == nil &&
+		l.req.Method == http.MethodOptions && status == http.StatusNoContent {
+		lvl := *l.opts.CORSPreflightLevel
+		l.levels.override = &lvl
+	}
+
+	// baseFields are always logged, and are replaced by their ECS equivalents
+	// with ElasticCommonSchema. fields are the rest of the response fields.
+	baseFields := []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddInt("status", status); return nil },
+		// Deprecated: "bytes" is superseded by "responseSizeBytes".
+		func(enc zapcore.ObjectEncoder) error { enc.AddInt("bytes", byteCnt); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddDuration("elapsed", elapsed); return nil },
+	}
+	if l.opts.ResponseBodySizeField {
+		baseFields = append(baseFields, func(enc zapcore.ObjectEncoder) error { enc.AddInt("responseSizeBytes", byteCnt); return nil })
+	}
+	var fields []objEncoderFn
+
+	if status >= 400 && l.opts.ErrorResponseParser != nil {
+		if body, _ := extra.([]byte); len(body) > 0 {
+			code, message := l.opts.ErrorResponseParser(header.Get("Content-Type"), body)
+			if code != "" {
+				fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("errorCode", code); return nil })
+			}
+			if message != "" {
+				fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("errorMessage", message); return nil })
+			}
+		}
+	}
+
+	if l.opts.ContextDeadlineLogging && errors.Is(l.req.Context().Err(), context.DeadlineExceeded) {
+		fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddBool("deadlineExceeded", true); return nil })
+	}
+
+	if l.opts.ContextErrorDetail {
+		fields = append(fields, contextErrorFields(l.req.Context())...)
+	}
+
+	if l.opts.DurationBudgetFunc != nil {
+		if budget := l.opts.DurationBudgetFunc(l.req); budget > 0 {
+			pct := math.Round(float64(elapsed) / float64(budget) * 100)
+			fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddFloat64("budgetConsumedPct", pct); return nil })
+			if elapsed > budget {
+				fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddBool("budgetExceeded", true); return nil })
+			}
+		}
+	}
+
+	if l.opts.HTTPSRedirectLogging && (status == http.StatusMovedPermanently || status == http.StatusFound) {
+		if scheme, _, _ := requestTarget(l.req, l.opts); scheme == "http" && strings.HasPrefix(header.Get("Location"), "https://") {
+			fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddBool("httpsUpgradeRedirect", true); return nil })
+		}
+	}
+
+	if l.opts.RetryAfterLogging && status == http.StatusTooManyRequests {
+		if v := header.Get("Retry-After"); v != "" {
+			fields = append(fields, retryAfterField(v, time.Now()))
+		}
+	}
+
+	if l.opts.LatencyTracker != nil {
+		fields = append(fields, latencyPercentileFields(l.opts.LatencyTracker.RecordAndQuery(l.req.Method, latencyPath(l.req), elapsed))...)
+	}
+
+	if l.opts.RequestMeter != nil {
+		body, _ := extra.([]byte)
+		in, out := l.opts.RequestMeter(l.req, body)
+		fields = append(fields,
+			func(enc zapcore.ObjectEncoder) error { enc.AddInt("inputTokens", in); return nil },
+			func(enc zapcore.ObjectEncoder) error { enc.AddInt("outputTokens", out); return nil },
+		)
+	}
+
+	if l.opts.CircuitBreakerStatus != nil {
+		if state := l.opts.CircuitBreakerStatus(l.req); state != "" {
+			fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("circuitBreakerState", state); return nil })
+		}
+	}
+
+	if l.opts.ContentNegotiationLogging {
+		fields = append(fields, contentNegotiationFields(l.req.Header.Get("Accept"), header.Get("Content-Type"))...)
+	}
+
+	if l.sse != nil && isEventStream(header) {
+		fields = append(fields, l.sse.fields()...)
+	}
+
+	grpcHeader := header
+	if l.grpcWeb != nil {
+		// Trailers-only gRPC-Web responses send the status in the headers.
+		if trailer, ok := l.grpcWeb.header(); ok {
+			grpcHeader = trailer
+		}
+	}
+	if l.opts.GRPCStatusLogging || l.grpcWeb != nil {
+		fields = append(fields, grpcStatusFields(grpcHeader)...)
+	}
+
+	if len(l.opts.GRPCTrailerFields) > 0 {
+		if f := trailerFields(header, l.opts.GRPCTrailerFields); f != nil {
+			fields = append(fields, f)
+		}
+	}
+
+	var missingHeaders []string
+	for _, h := range l.opts.RequiredSecurityHeaders {
+		if header.Get(h) == "" {
+			missingHeaders = append(missingHeaders, h)
+		}
+	}
+	if len(missingHeaders) > 0 {
+		fields = append(fields, func(enc zapcore.ObjectEncoder) error {
+			return enc.AddArray("missingSecurityHeaders", stringsMarshaler(missingHeaders))
+		})
+		l.raiseLevel(zapcore.WarnLevel)
+	}
+
+	if l.opts.CDNCacheStatusHeader != "" {
+		fields = append(fields, cdnCacheFields(header.Get(l.opts.CDNCacheStatusHeader), l.opts.CDNCacheHitValues)...)
+	}
+
+	if l.opts.RangeRequestLogging && status == http.StatusPartialContent {
+		fields = append(fields, contentRangeFields(header)...)
+	}
+
+	if !l.opts.Concise {
+		// Include response header, as well for error status codes (>=400, or those
+		// matching ResponseBodyConditions) we include the response body so we may
+		// inspect the log message sent back to the client.
+		body, _ := extra.([]byte)
+		if l.bodySkipped && l.opts.captureBody(status) {
+			fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("body", skippedSlowBody); return nil })
+		} else if l.opts.captureBody(status) && len(body) >= l.opts.ErrorBodyMinSize {
+			logged := body
+			if encoding := header.Get("Content-Encoding"); l.opts.ResponseBodyDecoding && encoding != "" {
+				var ok bool
+				if logged, ok = decodeBody(encoding, body); !ok {
+					fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("bodyEncoding", encoding); return nil })
+				}
+			}
+			fields = append(fields, func(enc zapcore.ObjectEncoder) error { addBody(enc, "body", logged, l.opts.BodyLogFormat); return nil })
+		}
+		if (l.opts.captureBody(status) || l.opts.CaptureBodyAlways) && l.opts.ResponseBodyHash.Available() && !l.bodySkipped {
+			h := l.opts.ResponseBodyHash.New()
+			h.Write(body)
+			sum := hex.EncodeToString(h.Sum(nil))
+			fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("responseBodyHash", sum); return nil })
+		}
+		if len(header) > 0 {
+			fields = append(fields, func(enc zapcore.ObjectEncoder) error {
+				return enc.AddObject(headersKey(l.opts.ResponseHeadersKey), toMarshaler(headerLogField(header, l.opts)))
+			})
+		}
+	}
+
+	for _, cf := range l.opts.ContextLogFields {
+		if v := l.req.Context().Value(cf.Key); v != nil {
+			field := cf.field(v)
+			fields = append(fields, func(enc zapcore.ObjectEncoder) error { field.AddTo(enc); return nil })
+		}
+	}
+
+	fields = append(fields, l.respFields...)
+
+	reqFields := l.reqFields
+	if l.opts.MetricsTagExtractor != nil {
+		if tags := l.opts.MetricsTagExtractor(l.req); len(tags) > 0 {
+			reqFields = append(copySlice(reqFields), func(enc zapcore.ObjectEncoder) error { return enc.AddObject("metricsTags", stringMapMarshaler(tags)) })
+		}
+	}
+	if l.opts.FeatureFlagLogger != nil {
+		if flags := l.opts.FeatureFlagLogger(l.req.Context()); len(flags) > 0 {
+			reqFields = append(copySlice(reqFields), func(enc zapcore.ObjectEncoder) error { return enc.AddObject("featureFlags", boolMapMarshaler(flags)) })
+		}
+	}
+
+	var logFields []zap.Field
+	if l.opts.ElasticCommonSchema {
+		logFields = ecsFields(l.req, l.opts, reqFields, &ecsResponse{status: status, bytes: byteCnt, elapsed: elapsed, fields: fields})
+	} else {
+		reqField := requestLogField(l.req, l.opts, reqFields)
+		respField := zap.Object("httpResponse", mapFieldNames(toMarshaler(append(baseFields, fields...)), l.opts.fieldNameMapper()))
+		logFields = []zap.Field{reqField, respField}
+	}
+	if l.logSeq != 0 {
+		logFields = append(logFields, zap.Uint64("logSeq", l.logSeq))
+	}
+	if l.errorRate != nil {
+		logFields = append(logFields, zap.Float64("errorRatePct", l.errorRate.record(time.Now(), logStatus >= 500)))
+	}
+	if l.opts.GCPTraceProjectID != "" {
+		logFields = append(logFields, gcpTraceFields(l.req.Header.Get(CloudTraceContextHeader), l.opts.GCPTraceProjectID)...)
+	}
+
+	if len(l.opts.EnvironmentSuppressedFields[l.opts.Environment]) > 0 {
+		kept := logFields[:0]
+		for _, f := range logFields {
+			if !l.opts.suppressed(f.Key) {
+				kept = append(kept, f)
+			}
+		}
+		logFields = kept
+	}
+
+	if l.opts.PreLogHook != nil {
+		l.opts.PreLogHook(l.req, status, elapsed)
+	}
+	statusLevelWithContext(l.req.Context(), l.logger, logStatus)(msg.String(), logFields...)
+	for _, extraLogger := range l.extraLoggers {
+		statusLevelWithContext(l.req.Context(), extraLogger, logStatus)(msg.String(), logFields...)
+	}
+	if l.opts.PostLogHook != nil {
+		l.opts.PostLogHook(l.req, status, elapsed)
+	}
+	if l.opts.AccessLogWriter != nil {
+		writeAccessLog(l.opts.AccessLogWriter, l.req, l.opts.maskRequestURI(l.req.RequestURI), status, byteCnt, l.opts.inTimeZone(time.Now().Add(-elapsed)))
+	}
+}
+
+func toMarshaler(in []objEncoderFn) zapcore.ObjectMarshaler {
+	return zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+		for _, f := range in {
+			if err := f(enc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-type Options struct {
-	// Concise mode includes fewer log details during the request flow. For example
-	// excluding details like request content length, user-agent and other details.
-	// This is useful if during development your console is too noisy.
-	Concise bool
-
-	// SkipHeaders are additional headers which are redacted from the logs
-	SkipHeaders []string
+func addBody(enc zapcore.ObjectEncoder, key string, body []byte, format BodyLogFormat) {
+	switch format {
+	case BodyLogHex:
+		enc.AddString(key, hex.EncodeToString(body))
+	case BodyLogBase64:
+		enc.AddString(key, base64.StdEncoding.EncodeToString(body))
+	case BodyLogAuto:
+		if utf8.Valid(body) {
+			enc.AddByteString(key, body)
+		} else {
+			enc.AddString(key, base64.StdEncoding.EncodeToString(body))
+		}
+	default:
+		enc.AddByteString(key, body)
+	}
 }
 
-func (o *Options) Clone() *Options {
-	if o == nil {
+func stringsMarshaler(in []string) zapcore.ArrayMarshaler {
+	return zapcore.ArrayMarshalerFunc(func(enc zapcore.ArrayEncoder) error {
+		for _, s := range in {
+			enc.AppendString(s)
+		}
 		return nil
-	}
+	})
+}
 
-	return &Options{
-		Concise:     o.Concise,
-		SkipHeaders: copySlice(o.SkipHeaders),
+// stringMapMarshaler logs a map of strings as an object, sorted by key.
+func stringMapMarshaler(m map[string]string) zapcore.ObjectMarshaler {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
-}
+	sort.Strings(keys)
 
-func copySlice[T any](in []T) []T {
-	if in == nil {
+	return zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+		for _, k := range keys {
+			enc.AddString(k, m[k])
+		}
 		return nil
+	})
+}
+
+// boolMapMarshaler logs a map of bools as an object, sorted by key.
+func boolMapMarshaler(m map[string]bool) zapcore.ObjectMarshaler {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
 
-	out := make([]T, len(in))
-	copy(out, in)
-	return out
+	return zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+		for _, k := range keys {
+			enc.AddBool(k, m[k])
+		}
+		return nil
+	})
 }
 
-func NewMiddleware(logger *zap.Logger, options ...Option) func(next http.Handler) http.Handler {
-	opts := defaultOptions.Clone()
-	for _, o := range options {
-		o(opts)
+func (l *requestLoggerEntry) Panic(v interface{}, stack []byte) {
+	panicFields := []zap.Field{
+		zap.ByteString("stacktrace", stack),
+		zap.Any("panic", v),
+	}
+	l.logger = l.logger.With(panicFields...)
+	for i, extraLogger := range l.extraLoggers {
+		l.extraLoggers[i] = extraLogger.With(panicFields...)
 	}
 
-	return func(next http.Handler) http.Handler {
-		fn := func(w http.ResponseWriter, r *http.Request) {
-			reqField := requestLogField(r, opts)
-			entry := &requestLoggerEntry{
-				msg:    fmt.Sprintf("%s %s", r.Method, r.URL.Path),
-				logger: logger.With(reqField),
-				opts:   opts,
-			}
+	l.msg = fmt.Sprintf("%+v", v)
+}
 
-			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+func requestLogField(r *http.Request, opts *Options, extra []objEncoderFn) zap.Field {
+	scheme, host, requestURL := requestTarget(r, opts)
+	fields := []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("requestURL", requestURL); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("requestMethod", r.Method); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("requestPath", requestPath(r, opts)); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("remoteIP", r.RemoteAddr); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("proto", r.Proto); return nil },
+	}
+	if reqID := requestID(r.Context()); reqID != "" {
+		fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("requestID", reqID); return nil })
+	}
+	fields = append(fields, optionalRequestFields(r, opts)...)
 
-			buf := newLimitBuffer(512)
-			ww.Tee(buf)
+	if !opts.Concise || opts.AlwaysLogScheme {
+		fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("scheme", scheme); return nil })
+	}
+	if !opts.Concise {
+		fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("host", host); return nil })
+		if f := requestHeaderField(r, opts); f != nil {
+			fields = append(fields, f)
+		}
+		if f := verboseOnlyField(r, opts); f != nil {
+			fields = append(fields, f)
+		}
+	}
 
-			t1 := time.Now()
-			defer func() {
-				var respBody []byte
-				if ww.Status() >= 400 {
-					respBody, _ = io.ReadAll(buf)
-				}
-				entry.Write(ww.Status(), ww.BytesWritten(), ww.Header(), time.Since(t1), respBody)
-			}()
+	fields = append(fields, extra...)
 
-			next.ServeHTTP(ww, middleware.WithLogEntry(r, entry))
+	return zap.Object("httpRequest", mapFieldNames(toMarshaler(fields), opts.fieldNameMapper()))
+}
+
+// verboseOnlyField returns a field adding the fields from opts.VerboseOnlyFields,
+// or nil if there are none.
+func verboseOnlyField(r *http.Request, opts *Options) objEncoderFn {
+	if opts.VerboseOnlyFields == nil {
+		return nil
+	}
+	zapFields := opts.VerboseOnlyFields(r)
+	if len(zapFields) == 0 {
+		return nil
+	}
+	return func(enc zapcore.ObjectEncoder) error {
+		for _, f := range zapFields {
+			f.AddTo(enc)
 		}
-		return http.HandlerFunc(fn)
+		return nil
 	}
 }
 
-type requestLoggerEntry struct {
-	logger *zap.Logger
-	msg    string
-	opts   *Options
+// requestTarget returns the scheme, host and full URL of the request to log,
+// which come from proxy headers with IngressHeaders.
+func requestTarget(r *http.Request, opts *Options) (scheme, host, requestURL string) {
+	scheme = "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host, requestURI := r.Host, r.RequestURI
+	if opts.IngressHeaders {
+		if fwdHost := r.Header.Get("X-Forwarded-Host"); fwdHost != "" {
+			host = fwdHost
+		}
+		if origURL := r.Header.Get("X-Original-URL"); origURL != "" {
+			requestURI = origURL
+		}
+	}
+	requestURI = opts.maskRequestURI(requestURI)
+	if strings.HasPrefix(requestURI, "http://") || strings.HasPrefix(requestURI, "https://") {
+		// Some proxies send the full original URL rather than just the path.
+		return scheme, host, requestURI
+	}
+	return scheme, host, fmt.Sprintf("%s://%s%s", scheme, host, requestURI)
 }
 
-func statusLabel(status int) string {
-	switch {
-	case status >= 100 && status < 300:
-		return "OK"
-	case status >= 300 && status < 400:
-		return "Redirect"
-	case status >= 400 && status < 500:
-		return "Client Error"
-	case status >= 500:
-		return "Server Error"
-	default:
-		return "Unknown"
+// requestHeaderField returns the field logging the request headers, or nil if
+// there are none.
+func requestHeaderField(r *http.Request, opts *Options) objEncoderFn {
+	if len(r.Header) == 0 {
+		return nil
+	}
+	return func(enc zapcore.ObjectEncoder) error {
+		return enc.AddObject(headersKey(opts.RequestHeadersKey), toMarshaler(headerLogField(r.Header, opts)))
 	}
 }
 
-func statusLevel(logger *zap.Logger, status int) func(string, ...zap.Field) {
-	switch {
-	case status <= 0:
-		return logger.Warn
-	case status < 400: // for codes in 100s, 200s, 300s
-		return logger.Info
-	case status >= 400 && status < 500:
-		return logger.Warn
-	case status >= 500:
-		return logger.Error
-	default:
-		return logger.Info
+// optionalRequestFields returns the fields of "httpRequest" that are only
+// logged when present or enabled by the options.
+func optionalRequestFields(r *http.Request, opts *Options) []objEncoderFn {
+	var fields []objEncoderFn
+	if corrID := GetCorrelationID(r.Context()); corrID != "" {
+		fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("correlationID", corrID); return nil })
+	}
+	if opts.OpenAPIOperationID != nil {
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			if opID := opts.OpenAPIOperationID(r.Method, rctx.RoutePattern()); opID != "" {
+				fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("operationId", opID); return nil })
+			}
+		}
 	}
-}
 
-type objEncoderFn func(enc zapcore.ObjectEncoder) error
+	if len(opts.OTelBaggageKeys) > 0 {
+		if f := baggageField(r.Context(), opts.OTelBaggageKeys); f != nil {
+			fields = append(fields, f)
+		}
+	}
 
-func headerLogField(header http.Header, opts *Options) []objEncoderFn {
-	var out []objEncoderFn
-	addStringField := func(k, v string) {
-		out = append(out, func(enc zapcore.ObjectEncoder) error { enc.AddString(k, v); return nil })
+	if opts.ClientCertLogging && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		fields = append(fields,
+			func(enc zapcore.ObjectEncoder) error {
+				enc.AddString("clientCertSubject", cert.Subject.String())
+				return nil
+			},
+			func(enc zapcore.ObjectEncoder) error {
+				enc.AddString("clientCertIssuer", cert.Issuer.String())
+				return nil
+			},
+			func(enc zapcore.ObjectEncoder) error {
+				enc.AddString("clientCertSerial", cert.SerialNumber.Text(16))
+				return nil
+			},
+			func(enc zapcore.ObjectEncoder) error {
+				opts.addTime(enc, "clientCertExpiry", cert.NotAfter)
+				return nil
+			},
+		)
 	}
-	for k, v := range header {
-		k = strings.ToLower(k)
-		if k == "authorization" || k == "cookie" || k == "set-cookie" {
-			addStringField(k, "***")
-			break
+
+	if opts.ContextDeadlineLogging {
+		if deadline, ok := r.Context().Deadline(); ok {
+			fields = append(fields, func(enc zapcore.ObjectEncoder) error {
+				enc.AddString("contextDeadline", opts.inTimeZone(deadline).Format(time.RFC3339Nano))
+				return nil
+			})
 		}
-		switch {
-		case len(v) == 0:
-			continue
-		case len(v) == 1:
-			addStringField(k, v[0])
-		default:
-			addStringField(k, fmt.Sprintf("[%s]", strings.Join(v, "], [")))
+	}
+
+	if opts.StructuredQueryParams && r.URL.RawQuery != "" {
+		fields = append(fields, func(enc zapcore.ObjectEncoder) error {
+			return enc.AddArray("queryParams", queryParamsMarshaler(r.URL.Query(), opts.QueryParamRedactKeys))
+		})
+	}
+
+	if opts.AWSRequestID {
+		if id := r.Header.Get("X-Amzn-RequestId"); id != "" {
+			fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("awsRequestId", id); return nil })
+		}
+		if id := r.Header.Get("X-Amzn-Trace-Id"); id != "" {
+			fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("awsTraceId", id); return nil })
 		}
+	}
 
-		for _, skip := range opts.SkipHeaders {
-			if k == skip {
-				addStringField(k, "***")
-				break
-			}
+	if opts.GeolocationDB != nil {
+		if f := countryCodeField(r, opts.GeolocationDB); f != nil {
+			fields = append(fields, f)
 		}
 	}
-	return out
-}
 
-func (l *requestLoggerEntry) Write(status, byteCnt int, header http.Header, elapsed time.Duration, extra interface{}) {
-	var msg bytes.Buffer
-	if l.msg != "" {
-		msg.WriteString(l.msg)
-		msg.WriteString(" - ")
+	if len(opts.BotPatterns) > 0 && isBot(r.UserAgent(), opts.BotPatterns) {
+		fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddBool("isBot", true); return nil })
 	}
-	msg.WriteString(strconv.Itoa(status))
-	msg.WriteRune(' ')
-	msg.WriteString(statusLabel(status))
 
-	fields := []objEncoderFn{
-		func(enc zapcore.ObjectEncoder) error { enc.AddInt("status", status); return nil },
-		func(enc zapcore.ObjectEncoder) error { enc.AddInt("bytes", byteCnt); return nil },
-		func(enc zapcore.ObjectEncoder) error { enc.AddDuration("elapsed", elapsed); return nil },
+	if opts.DeprecationRegistry != nil {
+		fields = append(fields, deprecationFields(r, opts.DeprecationRegistry)...)
 	}
 
-	if !l.opts.Concise {
-		// Include response header, as well for error status codes (>400) we include
-		// the response body so we may inspect the log message sent back to the client.
-		if status >= 400 {
-			body, _ := extra.([]byte)
-			fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddByteString("body", body); return nil })
+	if opts.ContentNegotiationLogging {
+		if accept := r.Header.Get("Accept"); accept != "" {
+			fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("acceptHeader", accept); return nil })
 		}
-		if len(header) > 0 {
+	}
+
+	if opts.RequestSignature != nil {
+		sig := opts.RequestSignature(r)
+		fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("requestSignature", sig); return nil })
+	}
+
+	if opts.ChiURLParams {
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && len(rctx.URLParams.Keys) > 0 {
+			fields = append(fields, func(enc zapcore.ObjectEncoder) error {
+				return enc.AddObject("urlParams", urlParamsMarshaler(rctx.URLParams, opts.URLParamRedactor))
+			})
+		}
+	}
+
+	if opts.PathParamExtractor != nil {
+		if params := opts.PathParamExtractor(r); len(params) > 0 {
+			if opts.URLParamRedactor != nil {
+				redacted := make(map[string]string, len(params))
+				for k, v := range params {
+					if opts.URLParamRedactor(k, v) {
+						v = "***"
+					}
+					redacted[k] = v
+				}
+				params = redacted
+			}
 			fields = append(fields, func(enc zapcore.ObjectEncoder) error {
-				return enc.AddObject("header", toMarshaler(headerLogField(header, l.opts)))
+				return enc.AddObject("pathParams", stringMapMarshaler(params))
 			})
 		}
 	}
 
-	log := statusLevel(l.logger, status)
+	return fields
+}
 
-	log(msg.String(), zap.Object("httpResponse", toMarshaler(fields)))
+// contextErrorFields returns the "contextError" and "contextErrorKind" fields
+// if ctx is done. The error is the context's cause, which may be more specific
+// than context.Canceled or context.DeadlineExceeded.
+func contextErrorFields(ctx context.Context) []objEncoderFn {
+	err := ctx.Err()
+	if err == nil {
+		return nil
+	}
+	kind := "cancelled"
+	if errors.Is(err, context.DeadlineExceeded) {
+		kind = "deadline"
+	}
+	msg := context.Cause(ctx).Error()
+	return []objEncoderFn{
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("contextError", msg); return nil },
+		func(enc zapcore.ObjectEncoder) error { enc.AddString("contextErrorKind", kind); return nil },
+	}
 }
 
-func toMarshaler(in []objEncoderFn) zapcore.ObjectMarshaler {
+// perfStatsField logs the change in memory stats over the course of a request.
+// The stats are process-wide, so they include allocations by other requests
+// being served concurrently.
+func perfStatsField(before, after *runtime.MemStats) objEncoderFn {
+	return func(enc zapcore.ObjectEncoder) error {
+		return enc.AddObject("perfStats", zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+			enc.AddInt64("heapAllocDelta", int64(after.HeapAlloc)-int64(before.HeapAlloc))
+			enc.AddUint64("totalAllocDelta", after.TotalAlloc-before.TotalAlloc)
+			enc.AddUint32("numGCDelta", after.NumGC-before.NumGC)
+			return nil
+		}))
+	}
+}
+
+// urlParamsMarshaler logs chi URL parameters as an object keyed by parameter
+// name.
+func urlParamsMarshaler(params chi.RouteParams, redact func(key, value string) bool) zapcore.ObjectMarshaler {
 	return zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
-		for _, f := range in {
-			if err := f(enc); err != nil {
-				return err
+		for i, k := range params.Keys {
+			if i >= len(params.Values) {
+				break
+			}
+			v := params.Values[i]
+			if redact != nil && redact(k, v) {
+				v = "***"
 			}
+			enc.AddString(k, v)
 		}
 		return nil
 	})
 }
 
-func (l *requestLoggerEntry) Panic(v interface{}, stack []byte) {
-	l.logger = l.logger.With(
-		zap.ByteString("stacktrace", stack),
-		zap.Any("panic", v),
-	)
+// queryParamsMarshaler logs query parameters as {"key": ..., "value": ...}
+// objects, sorted by key, with one object per value of repeated parameters.
+func queryParamsMarshaler(query url.Values, redactKeys []string) zapcore.ArrayMarshaler {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 
-	l.msg = fmt.Sprintf("%+v", v)
+	return zapcore.ArrayMarshalerFunc(func(enc zapcore.ArrayEncoder) error {
+		for _, k := range keys {
+			redact := isRedactedQueryKey(k, redactKeys)
+			for _, v := range query[k] {
+				if redact {
+					v = "***"
+				}
+				err := enc.AppendObject(zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+					enc.AddString("key", k)
+					enc.AddString("value", v)
+					return nil
+				}))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
 }
 
-func requestLogField(r *http.Request, opts *Options) zap.Field {
-	var fields []objEncoderFn
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
+// isRedactedQueryKey reports whether the values of the query parameter k are
+// redacted, as one of redactKeys.
+func isRedactedQueryKey(k string, redactKeys []string) bool {
+	for _, rk := range redactKeys {
+		if strings.EqualFold(k, rk) {
+			return true
+		}
 	}
-	requestURL := fmt.Sprintf("%s://%s%s", scheme, r.Host, r.RequestURI)
+	return false
+}
 
-	fields = append(fields,
-		func(enc zapcore.ObjectEncoder) error { enc.AddString("requestURL", requestURL); return nil },
-		func(enc zapcore.ObjectEncoder) error { enc.AddString("requestMethod", r.Method); return nil },
-		func(enc zapcore.ObjectEncoder) error { enc.AddString("requestPath", r.URL.Path); return nil },
-		func(enc zapcore.ObjectEncoder) error { enc.AddString("remoteIP", r.RemoteAddr); return nil },
-		func(enc zapcore.ObjectEncoder) error { enc.AddString("proto", r.Proto); return nil },
-	)
-	if reqID := middleware.GetReqID(r.Context()); reqID != "" {
-		fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("requestID", reqID); return nil })
+// redactQuery replaces the values of the parameters of the raw query string
+// that are in redactKeys with "***", leaving the rest of it as it was.
+func redactQuery(rawQuery string, redactKeys []string) string {
+	if len(redactKeys) == 0 || rawQuery == "" {
+		return rawQuery
+	}
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		rawKey, _, _ := strings.Cut(param, "=")
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			key = rawKey
+		}
+		if isRedactedQueryKey(key, redactKeys) {
+			params[i] = rawKey + "=***"
+		}
 	}
+	return strings.Join(params, "&")
+}
 
-	if opts.Concise {
-		return zap.Object("httpRequest", toMarshaler(fields))
+// requestPath returns the path of the request to log, which is normalized by
+// opts.PathNormalizer if one is set, and masked with opts.MaskedPathSegments.
+func requestPath(r *http.Request, opts *Options) string {
+	if opts.PathNormalizer != nil {
+		return opts.maskPath(opts.PathNormalizer(r))
 	}
+	return opts.maskPath(r.URL.Path)
+}
 
-	fields = append(fields, func(enc zapcore.ObjectEncoder) error { enc.AddString("scheme", scheme); return nil })
+// ChiPatternNormalizer is a path normalizer for use with WithPathNormalizer,
+// which returns the chi route pattern matched by the request (e.g.
+// "/users/{userID}/profile"), or the request path if no route was matched.
+func ChiPatternNormalizer(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			return pattern
+		}
+	}
+	return r.URL.Path
+}
 
-	if len(r.Header) > 0 {
-		fields = append(fields, func(enc zapcore.ObjectEncoder) error {
-			return enc.AddObject("header", toMarshaler(headerLogField(r.Header, opts)))
-		})
+// defaultRequestSignature is the request signature used by WithRequestSignature
+// when none is given.
+func defaultRequestSignature(r *http.Request) string {
+	return r.Method + ":" + ChiPatternNormalizer(r)
+}
+
+func bodyContentTypeAllowed(contentType string, opts *Options) bool {
+	if len(opts.BodyContentTypeAllowList) == 0 {
+		return true
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(mediaType)
+	for _, allowed := range opts.BodyContentTypeAllowList {
+		if strings.EqualFold(mediaType, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxTrackedConns is the number of distinct connections a connCounter tracks
+// before resetting its counts.
+const maxTrackedConns = 10000
+
+// connCounter counts the requests made on each connection, keyed by remote
+// address.
+type connCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newConnCounter() *connCounter {
+	return &connCounter{counts: make(map[string]int64)}
+}
+
+// inc increments and returns the count of requests for the given connection.
+func (c *connCounter) inc(remoteAddr string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.counts[remoteAddr]; !ok && len(c.counts) >= maxTrackedConns {
+		// The middleware can't tell when connections close, so rather than grow
+		// forever, start over.
+		c.counts = make(map[string]int64)
+	}
+	c.counts[remoteAddr]++
+	return c.counts[remoteAddr]
+}
+
+// pushRecorder wraps an HTTP/2 response writer to record the targets of server
+// pushes issued by the handler.
+type pushRecorder struct {
+	middleware.WrapResponseWriter
+	pusher  http.Pusher
+	targets []string
+}
+
+func (p *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	p.targets = append(p.targets, target)
+	return p.pusher.Push(target, opts)
+}
+
+func (p *pushRecorder) Flush() {
+	if f, ok := p.WrapResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
+}
 
-	return zap.Object("httpRequest", toMarshaler(fields))
+// bodyCapture is tee'd the response body, and captures up to limit bytes of it
+// if the response status satisfies capture. The status is checked on the first
+// write, once it's known, so no buffer is allocated for responses that won't
+// have their body logged.
+type bodyCapture struct {
+	status  func() int
+	capture func(status int) bool
+	limit   int
+
+	checked bool
+	buf     io.ReadWriter
+}
+
+func (b *bodyCapture) Write(p []byte) (int, error) {
+	if !b.checked {
+		b.checked = true
+		if b.capture(b.status()) {
+			b.buf = newLimitBuffer(b.limit)
+		}
+	}
+	if b.buf != nil {
+		b.buf.Write(p)
+	}
+	// The body is tee'd through an io.MultiWriter, which fails the handler's
+	// write on short writes, so the whole of p is always reported as written.
+	return len(p), nil
+}
 
+// body returns the captured body, if any.
+func (b *bodyCapture) body() []byte {
+	if b.buf == nil {
+		return nil
+	}
+	body, _ := io.ReadAll(b.buf)
+	return body
 }
 
+// defaultBodyCaptureLimit is the default maximum number of bytes of response
+// bodies to capture.
+const defaultBodyCaptureLimit = 512
+
+// incidentBuckets is the number of buckets errors are counted in for
+// IncidentWindow.
+const incidentBuckets = 10
+
+// skippedSlowBody is logged in place of the response body when the handler
+// took longer than BodyCaptureMaxAge.
+const skippedSlowBody = "[body skipped: handler too slow]"
+
 // limitBuffer is used to pipe response body information from the
 // response writer to a certain limit amount. The idea is to read
 // a portion of the response body such as an error response so we
@@ -274,14 +3019,17 @@ func newLimitBuffer(size int) io.ReadWriter {
 }
 
 func (b limitBuffer) Write(p []byte) (n int, err error) {
-	if b.Buffer.Len() >= b.limit {
+	room := b.limit - b.Buffer.Len()
+	if room <= 0 {
 		return len(p), nil
 	}
-	limit := b.limit
-	if len(p) < limit {
-		limit = len(p)
+	if len(p) < room {
+		room = len(p)
 	}
-	return b.Buffer.Write(p[:limit])
+	b.Buffer.Write(p[:room])
+	// Bytes over the limit are dropped silently, as a short write would be an
+	// error for the writer this one is tee'd from.
+	return len(p), nil
 }
 
 func (b limitBuffer) Read(p []byte) (n int, err error) {
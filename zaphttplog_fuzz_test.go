@@ -0,0 +1,38 @@
+package zaphttplog
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func FuzzHeaderLogField(f *testing.F) {
+	seeds := []struct {
+		key, values, skip string
+	}{
+		{"", "", ""},
+		{"X-Custom", "value", ""},
+		{"Accept", "text/html\x00application/json\x00*/*", ""},
+		{"Authorization", "Bearer \xff\xfe token", ""},
+		{"Cookie", "a=1; b=2; =; ;;c", "cookie"},
+		{"X-Secret", "secret", "x-secret"},
+		{"X-Large", strings.Repeat("x", 1<<16), ""},
+	}
+	for _, s := range seeds {
+		f.Add(s.key, s.values, s.skip, true)
+	}
+
+	f.Fuzz(func(t *testing.T, key, values, skip string, logCookieNames bool) {
+		// Values are NUL-separated, so a header can have several of them.
+		header := http.Header{key: strings.Split(values, "\x00")}
+		opts := &Options{SkipHeaders: strings.Split(skip, ","), LogCookieNames: logCookieNames}
+
+		fields := headerLogField(header, opts)
+		enc := zapcore.NewMapObjectEncoder()
+		if err := toMarshaler(fields).MarshalLogObject(enc); err != nil {
+			t.Errorf("failed to encode header fields: %v", err)
+		}
+	})
+}
@@ -1,12 +1,34 @@
 package zaphttplog
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestStatusLabel(t *testing.T) {
@@ -66,8 +88,9 @@ func TestStatusLevel(t *testing.T) {
 	})))
 
 	tests := []struct {
-		status int
-		want   func(string, ...zap.Field)
+		status   int
+		override *zapcore.Level
+		want     func(string, ...zap.Field)
 	}{
 		{
 			status: 0,
@@ -105,11 +128,34 @@ func TestStatusLevel(t *testing.T) {
 			status: http.StatusBadGateway,
 			want:   l.Error,
 		},
+		{
+			status:   http.StatusOK,
+			override: levelPtr(zapcore.DebugLevel),
+			want:     l.Debug,
+		},
+		{
+			status:   http.StatusOK,
+			override: levelPtr(zapcore.WarnLevel),
+			want:     l.Warn,
+		},
+		{
+			status:   http.StatusInternalServerError,
+			override: levelPtr(zapcore.InfoLevel),
+			want:     l.Info,
+		},
 	}
 
 	for _, test := range tests {
-		t.Run(http.StatusText(test.status), func(t *testing.T) {
-			got := statusLevel(l, test.status)
+		name := http.StatusText(test.status)
+		if test.override != nil {
+			name += " with " + test.override.String() + " override"
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx, _ := withLogLevelState(context.Background())
+			if test.override != nil {
+				SetRouteLogLevel(ctx, *test.override)
+			}
+			got := statusLevelWithContext(ctx, l, test.status)
 
 			// We can't directly compare `got` and `test.want` because they're functions, so
 			// we make sure they log to the appropriate levels instead.
@@ -122,7 +168,2356 @@ func TestStatusLevel(t *testing.T) {
 
 			gotLog, wantLog := logs[len(logs)-2], logs[len(logs)-1]
 			if gotLog.Level != wantLog.Level {
-				t.Errorf("statusLevel(%d) = %q, want %q", test.status, gotLog.Level, wantLog.Level)
+				t.Errorf("statusLevelWithContext(%d) = %q, want %q", test.status, gotLog.Level, wantLog.Level)
+			}
+		})
+	}
+}
+
+func levelPtr(lvl zapcore.Level) *zapcore.Level {
+	return &lvl
+}
+
+// cloneTestInterfaceValues holds a non-nil sample value for each interface type
+// that appears as a field on Options, since those can't be synthesized with
+// reflection alone.
+var cloneTestInterfaceValues = map[reflect.Type]reflect.Value{
+	reflect.TypeOf((*interface{})(nil)).Elem():         reflect.ValueOf("value"),
+	reflect.TypeOf((*io.Writer)(nil)).Elem():           reflect.ValueOf(io.Discard),
+	reflect.TypeOf((*context.Context)(nil)).Elem():     reflect.ValueOf(context.Background()),
+	reflect.TypeOf((*GeolocationDB)(nil)).Elem():       reflect.ValueOf(fakeGeolocationDB{}),
+	reflect.TypeOf((*DeprecationRegistry)(nil)).Elem(): reflect.ValueOf(MapDeprecationRegistry(nil)),
+	reflect.TypeOf((*LatencyTracker)(nil)).Elem():      reflect.ValueOf(NewHDRLatencyTracker(time.Second, 2)),
+}
+
+func TestOptionsCloneCompleteness(t *testing.T) {
+	var orig Options
+	origV := reflect.ValueOf(&orig).Elem()
+	typ := origV.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if !f.IsExported() {
+			t.Fatalf("Options.%s is unexported and can't be verified by this test", f.Name)
+		}
+		fillNonZero(t, f.Name, origV.Field(i))
+	}
+
+	clone := orig.Clone()
+	cloneV := reflect.ValueOf(clone).Elem()
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Name
+		if cloneV.Field(i).IsZero() {
+			t.Errorf("Options.Clone() did not copy field %q", name)
+			continue
+		}
+		checkNoSharedRefs(t, name, origV.Field(i), cloneV.Field(i))
+	}
+}
+
+// fillNonZero sets v to an arbitrary non-zero value of its type.
+func fillNonZero(t *testing.T, name string, v reflect.Value) {
+	t.Helper()
+
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		v.SetUint(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1)
+	case reflect.String:
+		v.SetString("value")
+	case reflect.Slice:
+		s := reflect.MakeSlice(v.Type(), 1, 1)
+		fillNonZero(t, name, s.Index(0))
+		v.Set(s)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			fillNonZero(t, name, v.Index(i))
+		}
+	case reflect.Map:
+		m := reflect.MakeMapWithSize(v.Type(), 1)
+		key, val := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+		fillNonZero(t, name, key)
+		fillNonZero(t, name, val)
+		m.SetMapIndex(key, val)
+		v.Set(m)
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+	case reflect.Chan:
+		v.Set(reflect.MakeChan(v.Type(), 0))
+	case reflect.Func:
+		v.Set(reflect.MakeFunc(v.Type(), func(args []reflect.Value) []reflect.Value {
+			out := make([]reflect.Value, v.Type().NumOut())
+			for i := range out {
+				out[i] = reflect.Zero(v.Type().Out(i))
+			}
+			return out
+		}))
+	case reflect.Interface:
+		sample, ok := cloneTestInterfaceValues[v.Type()]
+		if !ok {
+			t.Fatalf("no sample value for interface type %s (used by Options.%s), add one to cloneTestInterfaceValues", v.Type(), name)
+		}
+		v.Set(sample)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				fillNonZero(t, name, v.Field(i))
+			}
+		}
+	default:
+		t.Fatalf("unhandled kind %s for Options.%s", v.Kind(), name)
+	}
+}
+
+// checkNoSharedRefs verifies that mutable reference types (slices and maps)
+// don't share backing memory between the original and the clone.
+func checkNoSharedRefs(t *testing.T, name string, orig, clone reflect.Value) {
+	t.Helper()
+
+	switch orig.Kind() {
+	case reflect.Slice, reflect.Map:
+		if orig.Pointer() == clone.Pointer() {
+			t.Errorf("Options.Clone() shares %s memory for field %q", orig.Kind(), name)
+		}
+	case reflect.Struct:
+		for i := 0; i < orig.NumField(); i++ {
+			checkNoSharedRefs(t, name+"."+orig.Type().Field(i).Name, orig.Field(i), clone.Field(i))
+		}
+	}
+}
+
+func TestCaptureBody(t *testing.T) {
+	tests := []struct {
+		desc    string
+		options []Option
+		status  int
+		want    bool
+	}{
+		{desc: "default success", status: http.StatusOK, want: false},
+		{desc: "default error", status: http.StatusNotFound, want: true},
+		{desc: "code match", options: []Option{WithCaptureBodyForCodes(422, 503)}, status: 503, want: true},
+		{desc: "code mismatch", options: []Option{WithCaptureBodyForCodes(422, 503)}, status: 500, want: false},
+		{
+			desc:    "codes and conditions",
+			options: []Option{WithCaptureBodyForCodes(422), WithResponseBodyCondition(func(status int) bool { return status == 201 })},
+			status:  201,
+			want:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := newOptions(test.options).captureBody(test.status); got != test.want {
+				t.Errorf("captureBody(%d) = %t, want %t", test.status, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareRequestFields(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	srv := httptest.NewServer(NewMiddleware(zap.New(core))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/test?q=1", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest: %v", err)
+	}
+	req.Header.Set("X-Custom", "custom-value")
+	req.Header.Set("User-Agent", "zaphttplog-test")
+	doRequest(t, req)
+	// Closing the server waits for outstanding requests, and their logs, to finish.
+	srv.Close()
+
+	httpReq := loggedObject(t, logs, "httpRequest")
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	wantStrings := map[string]string{
+		"requestURL":    "http://" + host + "/test?q=1",
+		"requestMethod": http.MethodGet,
+		"requestPath":   "/test",
+		"proto":         "HTTP/1.1",
+		"scheme":        "http",
+		"host":          host,
+	}
+	for k, want := range wantStrings {
+		if got := httpReq[k]; got != want {
+			t.Errorf("httpRequest[%q] = %v, want %q", k, got, want)
+		}
+	}
+	if remoteIP, _ := httpReq["remoteIP"].(string); !strings.HasPrefix(remoteIP, "127.0.0.1:") {
+		t.Errorf("httpRequest[%q] = %q, want a 127.0.0.1 address", "remoteIP", remoteIP)
+	}
+
+	header, ok := httpReq["header"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("httpRequest[%q] = %v, want an object", "header", httpReq["header"])
+	}
+	wantHeader := map[string]string{
+		"x-custom":   "custom-value",
+		"user-agent": "zaphttplog-test",
+	}
+	for k, want := range wantHeader {
+		if got := header[k]; got != want {
+			t.Errorf("httpRequest.header[%q] = %v, want %q", k, got, want)
+		}
+	}
+}
+
+func TestMiddlewareResponseFields(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	srv := httptest.NewServer(NewMiddleware(zap.New(core))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Response", "response-value")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not found"))
+	})))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/missing", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest: %v", err)
+	}
+	doRequest(t, req)
+	srv.Close()
+
+	if got := logs.All()[0].Level; got != zapcore.WarnLevel {
+		t.Errorf("log level = %q, want %q", got, zapcore.WarnLevel)
+	}
+	if got, want := logs.All()[0].Message, "GET /missing - 404 Client Error"; got != want {
+		t.Errorf("log message = %q, want %q", got, want)
+	}
+
+	httpResp := loggedObject(t, logs, "httpResponse")
+
+	if got := httpResp["status"]; got != http.StatusNotFound {
+		t.Errorf("httpResponse[%q] = %v, want %d", "status", got, http.StatusNotFound)
+	}
+	for _, k := range []string{"bytes", "responseSizeBytes"} {
+		if got := httpResp[k]; got != len("not found") {
+			t.Errorf("httpResponse[%q] = %v, want %d", k, got, len("not found"))
+		}
+	}
+	if _, ok := httpResp["elapsed"].(time.Duration); !ok {
+		t.Errorf("httpResponse[%q] = %v, want a duration", "elapsed", httpResp["elapsed"])
+	}
+	if got := httpResp["body"]; got != "not found" {
+		t.Errorf("httpResponse[%q] = %v, want %q", "body", got, "not found")
+	}
+	if got, ok := httpResp["responseBodyHash"]; ok {
+		t.Errorf("httpResponse[%q] = %v, want no field", "responseBodyHash", got)
+	}
+
+	header, ok := httpResp["header"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("httpResponse[%q] = %v, want an object", "header", httpResp["header"])
+	}
+	if got := header["x-response"]; got != "response-value" {
+		t.Errorf("httpResponse.header[%q] = %v, want %q", "x-response", got, "response-value")
+	}
+}
+
+func TestMiddlewareVerboseHeader(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithConcise(true), WithEnableVerboseHeader("X-Debug", "letmein"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	tests := []struct {
+		desc        string
+		value       string
+		wantVerbose bool
+	}{
+		{desc: "no header"},
+		{desc: "wrong secret", value: "nope"},
+		{desc: "secret", value: "letmein", wantVerbose: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			logs.TakeAll()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.value != "" {
+				req.Header.Set("X-Debug", test.value)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			httpResp := loggedObject(t, logs, "httpResponse")
+			if _, got := httpResp["body"]; got != test.wantVerbose {
+				t.Errorf("httpResponse has body = %t, want %t", got, test.wantVerbose)
+			}
+			header, got := loggedObject(t, logs, "httpRequest")["header"].(map[string]interface{})
+			if got != test.wantVerbose {
+				t.Fatalf("httpRequest has header = %t, want %t", got, test.wantVerbose)
+			}
+			if got && header["x-debug"] != "***" {
+				t.Errorf("httpRequest.header[%q] = %v, want %q", "x-debug", header["x-debug"], "***")
+			}
+		})
+	}
+}
+
+func TestMiddlewareContextLogFields(t *testing.T) {
+	type ctxKey string
+	core, logs := observer.New(zapcore.DebugLevel)
+	mw := NewMiddleware(zap.New(core),
+		WithContextLogField(ctxKey("user"), "userID", nil),
+		WithContextLogField(ctxKey("flags"), "", func(v interface{}) zap.Field { return zap.Strings("flags", v.([]string)) }),
+		WithContextLogField(ctxKey("missing"), "missing", nil),
+	)
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx := context.WithValue(req.Context(), ctxKey("user"), "u-123")
+	ctx = context.WithValue(ctx, ctxKey("flags"), []string{"beta"})
+	h.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+
+	httpResp := loggedObject(t, logs, "httpResponse")
+	if got := httpResp["userID"]; got != "u-123" {
+		t.Errorf("httpResponse[%q] = %v, want %q", "userID", got, "u-123")
+	}
+	if got, want := httpResp["flags"], []interface{}{"beta"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("httpResponse[%q] = %v, want %v", "flags", got, want)
+	}
+	if got, ok := httpResp["missing"]; ok {
+		t.Errorf("httpResponse[%q] = %v, want no field", "missing", got)
+	}
+}
+
+func TestMiddlewareResponseBodyHash(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithResponseBodyHash(crypto.SHA256))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	sum := sha256.Sum256([]byte("oops\n"))
+	if got, want := loggedObject(t, logs, "httpResponse")["responseBodyHash"], hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("httpResponse[%q] = %v, want %q", "responseBodyHash", got, want)
+	}
+}
+
+func TestMiddlewareCaptureBodyAlways(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithResponseBodyHash(crypto.SHA256), WithCaptureBodyAlways(true))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	httpResp := loggedObject(t, logs, "httpResponse")
+	if got, ok := httpResp["body"]; ok {
+		t.Errorf("httpResponse[%q] = %v, want no field", "body", got)
+	}
+	sum := sha256.Sum256([]byte("ok"))
+	if got, want := httpResp["responseBodyHash"], hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("httpResponse[%q] = %v, want %q", "responseBodyHash", got, want)
+	}
+}
+
+func TestMiddlewareMaskedPathSegments(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	mw := NewMiddleware(zap.New(core), WithMaskedPathSegments([]*regexp.Regexp{regexp.MustCompile(`[^/]+@[^/]+`)}))
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/jane@example.com/profile", nil))
+
+	httpReq := loggedObject(t, logs, "httpRequest")
+	if got, want := httpReq["requestPath"], "/users/<redacted>/profile"; got != want {
+		t.Errorf("httpRequest[%q] = %v, want %q", "requestPath", got, want)
+	}
+	if got, want := httpReq["requestURL"], "http://example.com/users/<redacted>/profile"; got != want {
+		t.Errorf("httpRequest[%q] = %v, want %q", "requestURL", got, want)
+	}
+	if got, want := logs.All()[0].Message, "GET /users/<redacted>/profile - 200 OK"; got != want {
+		t.Errorf("log message = %q, want %q", got, want)
+	}
+}
+
+func TestMiddlewareSecurityHeaderAudit(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithSecurityHeaderAudit([]string{"X-Content-Type-Options", "X-Frame-Options"}))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Write([]byte("ok"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	httpResp := loggedObject(t, logs, "httpResponse")
+	if got, want := httpResp["missingSecurityHeaders"], []interface{}{"X-Frame-Options"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("httpResponse[%q] = %v, want %v", "missingSecurityHeaders", got, want)
+	}
+	if got := logs.All()[0].Level; got != zapcore.WarnLevel {
+		t.Errorf("log level = %q, want %q", got, zapcore.WarnLevel)
+	}
+}
+
+func TestMiddlewareConcurrencyLimit(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	sem := make(chan struct{}, 1)
+	h := NewMiddleware(zap.New(core), WithConcurrencyLimitChan(sem))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	// Hold the only slot, so the request is abandoned once its context is done.
+	sem <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if rec.Body.Len() != 0 {
+		t.Errorf("handler was called for an abandoned request")
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("response status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if got := loggedObject(t, logs, "httpResponse")["status"]; got != http.StatusServiceUnavailable {
+		t.Errorf("httpResponse[%q] = %v, want %d", "status", got, http.StatusServiceUnavailable)
+	}
+	httpReq := loggedObject(t, logs, "httpRequest")
+	if got := httpReq["queueAbandoned"]; got != true {
+		t.Errorf("httpRequest[%q] = %v, want true", "queueAbandoned", got)
+	}
+	if wait, _ := httpReq["queueWaitDuration"].(time.Duration); wait < 10*time.Millisecond {
+		t.Errorf("httpRequest[%q] = %v, want at least 10ms", "queueWaitDuration", httpReq["queueWaitDuration"])
+	}
+
+	<-sem
+	logs.TakeAll()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if _, ok := loggedObject(t, logs, "httpRequest")["queueWaitDuration"].(time.Duration); !ok {
+		t.Errorf("httpRequest has no %q duration", "queueWaitDuration")
+	}
+	if len(sem) != 0 {
+		t.Errorf("slot wasn't released after the request")
+	}
+}
+
+func TestContextErrorFields(t *testing.T) {
+	errClientGone := errors.New("client went away")
+	cancelled, cancel := context.WithCancelCause(context.Background())
+	cancel(errClientGone)
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now())
+	defer cancelExpired()
+
+	tests := []struct {
+		desc     string
+		ctx      context.Context
+		wantErr  string
+		wantKind string
+	}{
+		{desc: "not done", ctx: context.Background()},
+		{desc: "cancelled", ctx: cancelled, wantErr: errClientGone.Error(), wantKind: "cancelled"},
+		{desc: "deadline", ctx: expired, wantErr: context.DeadlineExceeded.Error(), wantKind: "deadline"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			enc := zapcore.NewMapObjectEncoder()
+			for _, f := range contextErrorFields(test.ctx) {
+				f(enc)
+			}
+			if got := enc.Fields["contextError"]; test.wantErr != "" && got != test.wantErr {
+				t.Errorf("contextError = %v, want %q", got, test.wantErr)
+			}
+			if got, _ := enc.Fields["contextErrorKind"].(string); got != test.wantKind {
+				t.Errorf("contextErrorKind = %q, want %q", got, test.wantKind)
+			}
+		})
+	}
+}
+
+func TestMiddlewareEnvironment(t *testing.T) {
+	t.Setenv("ZAPHTTPLOG_TEST_ENV", "staging")
+
+	tests := []struct {
+		desc    string
+		option  Option
+		want    string
+		wantSet bool
+	}{
+		{desc: "explicit", option: WithEnvironment("prod"), want: "prod", wantSet: true},
+		{desc: "from env", option: WithEnvironmentFromEnv("ZAPHTTPLOG_TEST_ENV"), want: "staging", wantSet: true},
+		{desc: "unset env", option: WithEnvironmentFromEnv("ZAPHTTPLOG_TEST_UNSET")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), test.option)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			got, ok := logs.All()[0].ContextMap()["env"]
+			if ok != test.wantSet || (ok && got != test.want) {
+				t.Errorf("env = %v (set: %t), want %q (set: %t)", got, ok, test.want, test.wantSet)
+			}
+		})
+	}
+}
+
+func TestMiddlewareTimeZone(t *testing.T) {
+	jst := time.FixedZone("JST", 9*60*60)
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithRequestStartTime(true), WithTimeZone(jst))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	got, _ := loggedObject(t, logs, "httpRequest")["requestReceivedAt"].(string)
+	received, err := time.Parse(time.RFC3339Nano, got)
+	if err != nil {
+		t.Fatalf("httpRequest[%q] = %q, want an RFC 3339 time: %v", "requestReceivedAt", got, err)
+	}
+	if _, offset := received.Zone(); offset != 9*60*60 {
+		t.Errorf("httpRequest[%q] = %q, want a time in JST", "requestReceivedAt", got)
+	}
+}
+
+func doRequest(t *testing.T, req *http.Request) {
+	t.Helper()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Fatalf("failed to read response body: %v", err)
+	}
+}
+
+// loggedObject returns the object-valued field with the given key from the only
+// log line that was written.
+func loggedObject(t *testing.T, logs *observer.ObservedLogs, key string) map[string]interface{} {
+	t.Helper()
+
+	if logs.Len() != 1 {
+		t.Fatalf("%d lines were logged, want 1", logs.Len())
+	}
+	obj, ok := logs.All()[0].ContextMap()[key].(map[string]interface{})
+	if !ok {
+		t.Fatalf("log line has no %q object, fields were %+v", key, logs.All()[0].ContextMap())
+	}
+	return obj
+}
+
+func TestMiddlewareRequestSignature(t *testing.T) {
+	tests := []struct {
+		desc string
+		fn   func(r *http.Request) string
+		want string
+	}{
+		{desc: "default", want: "GET:/users/{userID}"},
+		{
+			desc: "custom",
+			fn:   func(r *http.Request) string { return "custom:" + r.Method },
+			want: "custom:GET",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			router := chi.NewRouter()
+			router.Use(NewMiddleware(zap.New(core), WithRequestSignature(test.fn)))
+			router.Get("/users/{userID}", func(w http.ResponseWriter, r *http.Request) {})
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/123", nil))
+
+			if got := loggedObject(t, logs, "httpRequest")["requestSignature"]; got != test.want {
+				t.Errorf("httpRequest[%q] = %v, want %q", "requestSignature", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareAWSRequestID(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithAWSRequestID(true))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Amzn-RequestId", "c6af9ac6-7b61-11e6-9a41-93e8deadbeef")
+	req.Header.Set("X-Amzn-Trace-Id", "Root=1-5759e988-bd862e3fe1be46a994272793")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	httpReq := loggedObject(t, logs, "httpRequest")
+	want := map[string]string{
+		"awsRequestId": "c6af9ac6-7b61-11e6-9a41-93e8deadbeef",
+		"awsTraceId":   "Root=1-5759e988-bd862e3fe1be46a994272793",
+	}
+	for k, v := range want {
+		if got := httpReq[k]; got != v {
+			t.Errorf("httpRequest[%q] = %v, want %q", k, got, v)
+		}
+	}
+}
+
+func TestMiddlewareRequiredRequestHeaders(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	var called bool
+	h := NewMiddleware(zap.New(core), WithRequiredRequestHeaders([]string{"X-API-Version", "Accept"}))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.Write([]byte("ok"))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/json")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !called {
+		t.Error("handler wasn't called")
+	}
+	httpReq := loggedObject(t, logs, "httpRequest")
+	if got, want := httpReq["missingRequestHeaders"], []interface{}{"X-API-Version"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("httpRequest[%q] = %v, want %v", "missingRequestHeaders", got, want)
+	}
+	if got := logs.All()[0].Level; got != zapcore.WarnLevel {
+		t.Errorf("log level = %q, want %q", got, zapcore.WarnLevel)
+	}
+}
+
+func TestMiddlewareCORSPreflightLevel(t *testing.T) {
+	tests := []struct {
+		desc   string
+		method string
+		status int
+		want   zapcore.Level
+	}{
+		{desc: "preflight", method: http.MethodOptions, status: http.StatusNoContent, want: zapcore.DebugLevel},
+		{desc: "OPTIONS with another status", method: http.MethodOptions, status: http.StatusOK, want: zapcore.InfoLevel},
+		{desc: "not OPTIONS", method: http.MethodDelete, status: http.StatusNoContent, want: zapcore.InfoLevel},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithCORSPreflightLevel(zapcore.DebugLevel))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(test.method, "/", nil))
+
+			if logs.Len() != 1 {
+				t.Fatalf("%d lines were logged, want 1", logs.Len())
+			}
+			if got := logs.All()[0].Level; got != test.want {
+				t.Errorf("log level = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareHTTPSRedirectLogging(t *testing.T) {
+	tests := []struct {
+		desc     string
+		url      string
+		status   int
+		location string
+		want     bool
+	}{
+		{desc: "upgrade", url: "http://example.com/a", status: http.StatusMovedPermanently, location: "https://example.com/a", want: true},
+		{desc: "found", url: "http://example.com/a", status: http.StatusFound, location: "https://example.com/a", want: true},
+		{desc: "plain redirect", url: "http://example.com/a", status: http.StatusFound, location: "http://example.com/b"},
+		{desc: "already HTTPS", url: "https://example.com/a", status: http.StatusFound, location: "https://example.com/b"},
+		{desc: "other status", url: "http://example.com/a", status: http.StatusTemporaryRedirect, location: "https://example.com/a"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithHTTPSRedirectLogging(true))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, test.location, test.status)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, test.url, nil))
+
+			if _, got := loggedObject(t, logs, "httpResponse")["httpsUpgradeRedirect"]; got != test.want {
+				t.Errorf("httpResponse has httpsUpgradeRedirect = %t, want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRedactAuthorization(t *testing.T) {
+	tests := []struct {
+		desc   string
+		values []string
+		n      int
+		want   string
+	}{
+		{desc: "disabled", values: []string{"Bearer abcdefghijkl"}, n: 0, want: "***"},
+		{desc: "bearer", values: []string{"Bearer abcdefghijkl"}, n: 8, want: "Bearer abcdefgh..."},
+		{desc: "lowercase bearer", values: []string{"bearer abcdefghijkl"}, n: 8, want: "bearer abcdefgh..."},
+		{desc: "short token", values: []string{"Bearer abcd"}, n: 8, want: "***"},
+		{desc: "basic auth", values: []string{"Basic dXNlcjpwYXNz"}, n: 8, want: "***"},
+		{desc: "multiple values", values: []string{"Bearer abcdefghijkl", "Bearer mnopqrstuvwx"}, n: 8, want: "***"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := redactAuthorization(test.values, test.n); got != test.want {
+				t.Errorf("redactAuthorization(%q, %d) = %q, want %q", test.values, test.n, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareEnvironmentFilter(t *testing.T) {
+	tests := []struct {
+		env          string
+		wantFiltered bool
+	}{
+		{env: "dev", wantFiltered: true},
+		{env: "prod", wantFiltered: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.env, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core),
+				WithEnvironmentFilter("dev", []string{"proto", "elapsed", "logSeq"}),
+				WithEnvironment(test.env),
+				WithLogID(true),
+			)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			httpReq := loggedObject(t, logs, "httpRequest")
+			httpResp := loggedObject(t, logs, "httpResponse")
+			_, hasLogSeq := logs.All()[0].ContextMap()["logSeq"]
+			for name, logged := range map[string]bool{
+				"httpRequest.proto":    httpReq["proto"] != nil,
+				"httpResponse.elapsed": httpResp["elapsed"] != nil,
+				"logSeq":               hasLogSeq,
+			} {
+				if logged == test.wantFiltered {
+					t.Errorf("%s logged = %t, want %t", name, logged, !test.wantFiltered)
+				}
+			}
+			if httpResp["status"] == nil {
+				t.Error("httpResponse.status wasn't logged")
+			}
+		})
+	}
+}
+
+func TestMiddlewareConcise(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithConcise(true))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("bad request"))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Custom", "custom-value")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	httpReq := loggedObject(t, logs, "httpRequest")
+	for _, k := range []string{"scheme", "header"} {
+		if _, ok := httpReq[k]; ok {
+			t.Errorf("httpRequest has a %q field in concise mode", k)
+		}
+	}
+	httpResp := loggedObject(t, logs, "httpResponse")
+	for _, k := range []string{"header", "body"} {
+		if _, ok := httpResp[k]; ok {
+			t.Errorf("httpResponse has a %q field in concise mode", k)
+		}
+	}
+	if got := httpResp["status"]; got != http.StatusBadRequest {
+		t.Errorf("httpResponse[%q] = %v, want %d", "status", got, http.StatusBadRequest)
+	}
+}
+
+func TestMiddlewareVerboseOnlyFields(t *testing.T) {
+	for _, concise := range []bool{false, true} {
+		t.Run(fmt.Sprintf("concise=%t", concise), func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			var called bool
+			fn := func(r *http.Request) []zap.Field {
+				called = true
+				return []zap.Field{zap.String("country", "NZ")}
+			}
+			h := NewMiddleware(zap.New(core), WithConcise(concise), WithVerboseOnlyFields(fn))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if called == concise {
+				t.Errorf("fn called = %t, want %t", called, !concise)
+			}
+			_, logged := loggedObject(t, logs, "httpRequest")["country"]
+			if logged == concise {
+				t.Errorf("httpRequest has country = %t, want %t", logged, !concise)
+			}
+		})
+	}
+}
+
+func TestMiddlewareErrorBodyMinSize(t *testing.T) {
+	tests := []struct {
+		desc     string
+		body     string
+		wantBody bool
+	}{
+		{desc: "too small", body: "x", wantBody: false},
+		{desc: "large enough", body: "invalid request", wantBody: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithErrorBodyMinSize(4))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(test.body))
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if _, got := loggedObject(t, logs, "httpResponse")["body"]; got != test.wantBody {
+				t.Errorf("httpResponse has body = %t, want %t", got, test.wantBody)
+			}
+		})
+	}
+}
+
+func TestMiddlewareAdaptiveBodyCapture(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithAdaptiveBodyCapture(4, 100, 1, time.Minute))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("0123456789"))
+	}))
+
+	// The incident limit is used once more than one error was counted.
+	want := []string{"0123", "0123", "0123456789"}
+	for range want {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	entries := logs.All()
+	if len(entries) != len(want) {
+		t.Fatalf("%d lines were logged, want %d", len(entries), len(want))
+	}
+	for i, e := range entries {
+		httpResp, _ := e.ContextMap()["httpResponse"].(map[string]interface{})
+		if got := httpResp["body"]; got != want[i] {
+			t.Errorf("request %d: httpResponse[%q] = %v, want %q", i, "body", got, want[i])
+		}
+	}
+}
+
+func TestMiddlewareEchoCorrelationHeader(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	var gotID string
+	h := NewMiddleware(zap.New(core), WithEchoCorrelationHeader("X-Correlation-ID", "X-Request-Correlation"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotID = GetCorrelationID(r.Context())
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Correlation-ID", "abc123")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("X-Request-Correlation"); got != "abc123" {
+		t.Errorf("response header = %q, want %q", got, "abc123")
+	}
+	if gotID != "abc123" {
+		t.Errorf("GetCorrelationID() = %q, want %q", gotID, "abc123")
+	}
+	if got := loggedObject(t, logs, "httpRequest")["correlationID"]; got != "abc123" {
+		t.Errorf("httpRequest[%q] = %v, want %q", "correlationID", got, "abc123")
+	}
+}
+
+func TestRetryAfterField(t *testing.T) {
+	now := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		desc  string
+		value string
+		want  map[string]interface{}
+	}{
+		{
+			desc:  "seconds",
+			value: "120",
+			want:  map[string]interface{}{"retryAfterSecs": float64(120)},
+		},
+		{
+			desc:  "HTTP date",
+			value: "Sun, 01 Oct 2023 12:01:30 GMT",
+			want:  map[string]interface{}{"retryAfterSecs": float64(90)},
+		},
+		{
+			desc:  "date in the past",
+			value: "Sun, 01 Oct 2023 11:00:00 GMT",
+			want:  map[string]interface{}{"retryAfterSecs": float64(0)},
+		},
+		{
+			desc:  "invalid",
+			value: "soon",
+			want:  map[string]interface{}{"retryAfterRaw": "soon"},
+		},
+		{
+			desc:  "negative",
+			value: "-5",
+			want:  map[string]interface{}{"retryAfterRaw": "-5"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			enc := zapcore.NewMapObjectEncoder()
+			retryAfterField(test.value, now)(enc)
+			if !reflect.DeepEqual(enc.Fields, test.want) {
+				t.Errorf("retryAfterField(%q) = %+v, want %+v", test.value, enc.Fields, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareConcurrentRequestGauge(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := NewMiddleware(zap.New(core), WithConcurrentRequestGauge(true))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+	}()
+	<-started
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fast", nil))
+	close(release)
+	<-done
+
+	tests := []struct {
+		path       string
+		wantBefore int64
+		wantAfter  int64
+	}{
+		{path: "/fast", wantBefore: 1, wantAfter: 1},
+		{path: "/slow", wantBefore: 0, wantAfter: 0},
+	}
+	entries := logs.All()
+	if len(entries) != len(tests) {
+		t.Fatalf("%d lines were logged, want %d", len(entries), len(tests))
+	}
+	for i, test := range tests {
+		fields := entries[i].ContextMap()
+		httpReq, _ := fields["httpRequest"].(map[string]interface{})
+		httpResp, _ := fields["httpResponse"].(map[string]interface{})
+		if got := httpReq["requestPath"]; got != test.path {
+			t.Fatalf("line %d is for %v, want %s", i, got, test.path)
+		}
+		if got := httpReq["inFlightBefore"]; got != test.wantBefore {
+			t.Errorf("%s: httpRequest[%q] = %v, want %d", test.path, "inFlightBefore", got, test.wantBefore)
+		}
+		if got := httpResp["inFlightAfter"]; got != test.wantAfter {
+			t.Errorf("%s: httpResponse[%q] = %v, want %d", test.path, "inFlightAfter", got, test.wantAfter)
+		}
+	}
+}
+
+func TestMiddlewareRequestMeter(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	meter := func(r *http.Request, respBody []byte) (int, int) {
+		var usage struct {
+			Input  int `json:"input_tokens"`
+			Output int `json:"output_tokens"`
+		}
+		json.Unmarshal(respBody, &usage)
+		return usage.Input, usage.Output
+	}
+	h := NewMiddleware(zap.New(core), WithRequestMeter(meter))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"input_tokens": 12, "output_tokens": 34}`))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/completions", nil))
+
+	httpResp := loggedObject(t, logs, "httpResponse")
+	if got := httpResp["inputTokens"]; got != 12 {
+		t.Errorf("httpResponse[%q] = %v, want 12", "inputTokens", got)
+	}
+	if got := httpResp["outputTokens"]; got != 34 {
+		t.Errorf("httpResponse[%q] = %v, want 34", "outputTokens", got)
+	}
+	if _, ok := httpResp["body"]; ok {
+		t.Error("httpResponse has a body for a 200 response")
+	}
+}
+
+func TestMiddlewareCircuitBreakerStatus(t *testing.T) {
+	tests := []struct {
+		state string
+		want  interface{}
+	}{
+		{state: "half-open", want: "half-open"},
+		{state: "", want: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.state, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			status := func(r *http.Request) string { return test.state }
+			h := NewMiddleware(zap.New(core), WithCircuitBreakerStatus(status))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if got := loggedObject(t, logs, "httpResponse")["circuitBreakerState"]; got != test.want {
+				t.Errorf("httpResponse[%q] = %v, want %v", "circuitBreakerState", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareFeatureFlagLogger(t *testing.T) {
+	type flagsKey struct{}
+	tests := []struct {
+		desc  string
+		flags map[string]bool
+		want  interface{}
+	}{
+		{
+			desc:  "flags",
+			flags: map[string]bool{"new-checkout": true, "dark-mode": false},
+			want:  map[string]interface{}{"new-checkout": true, "dark-mode": false},
+		},
+		{
+			desc:  "no flags",
+			flags: map[string]bool{},
+			want:  nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			flagLogger := func(ctx context.Context) map[string]bool {
+				flags, _ := ctx.Value(flagsKey{}).(map[string]bool)
+				return flags
+			}
+			h := NewMiddleware(zap.New(core), WithFeatureFlagLogger(flagLogger))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			h.ServeHTTP(httptest.NewRecorder(), req.WithContext(context.WithValue(req.Context(), flagsKey{}, test.flags)))
+
+			if got := loggedObject(t, logs, "httpRequest")["featureFlags"]; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("httpRequest[%q] = %v, want %v", "featureFlags", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareID(t *testing.T) {
+	uuidRE := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	tests := []struct {
+		id    string
+		match func(string) bool
+	}{
+		{id: "auth-layer", match: func(got string) bool { return got == "auth-layer" }},
+		{id: "", match: uuidRE.MatchString},
+	}
+
+	for _, test := range tests {
+		t.Run(test.id, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithMiddlewareID(test.id))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if logs.Len() != 1 {
+				t.Fatalf("%d lines were logged, want 1", logs.Len())
+			}
+			got, _ := logs.All()[0].ContextMap()["middlewareID"].(string)
+			if !test.match(got) {
+				t.Errorf("middlewareID = %q, want %q or a UUID if empty", got, test.id)
+			}
+		})
+	}
+}
+
+func TestHeaderLogFieldSensitiveHeaderFn(t *testing.T) {
+	header := http.Header{
+		"Authorization": {"Bearer secret"},
+		"X-Api-Key":     {"key"},
+		"Accept":        {"*/*"},
+	}
+	defaultFn := DefaultSensitiveHeaderFn()
+	tests := []struct {
+		desc string
+		fn   func(string) bool
+		want map[string]interface{}
+	}{
+		{
+			desc: "default",
+			want: map[string]interface{}{"authorization": "***", "x-api-key": "key", "accept": "*/*"},
+		},
+		{
+			desc: "custom",
+			fn:   func(k string) bool { return k == "x-api-key" || defaultFn(k) },
+			want: map[string]interface{}{"authorization": "***", "x-api-key": "***", "accept": "*/*"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			enc := zapcore.NewMapObjectEncoder()
+			if err := toMarshaler(headerLogField(header, &Options{SensitiveHeaderFn: test.fn})).MarshalLogObject(enc); err != nil {
+				t.Fatalf("failed to encode header fields: %v", err)
+			}
+			if !reflect.DeepEqual(enc.Fields, test.want) {
+				t.Errorf("header fields = %+v, want %+v", enc.Fields, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareAlwaysLogScheme(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithConcise(true), WithAlwaysLogScheme(true))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	httpReq := loggedObject(t, logs, "httpRequest")
+	if got := httpReq["scheme"]; got != "https" {
+		t.Errorf("httpRequest[%q] = %v, want %q", "scheme", got, "https")
+	}
+	if _, ok := httpReq["host"]; ok {
+		t.Errorf("httpRequest has a %q field in concise mode", "host")
+	}
+}
+
+func TestHeaderLogFieldSkipHeaders(t *testing.T) {
+	header := http.Header{
+		"X-Secret": {"raw-secret-value"},
+		"Accept":   {"*/*"},
+	}
+	fields := headerLogField(header, &Options{SkipHeaders: []string{"x-secret"}})
+
+	buf, err := zapcore.NewJSONEncoder(zapcore.EncoderConfig{}).EncodeEntry(zapcore.Entry{}, []zapcore.Field{zap.Object("header", toMarshaler(fields))})
+	if err != nil {
+		t.Fatalf("failed to encode header fields: %v", err)
+	}
+	got := buf.String()
+	if strings.Contains(got, "raw-secret-value") {
+		t.Errorf("encoded headers %s contain the skipped header's value", got)
+	}
+	if n := strings.Count(got, `"x-secret"`); n != 1 {
+		t.Errorf("encoded headers %s have %d x-secret fields, want 1", got, n)
+	}
+	if !strings.Contains(got, `"x-secret":"***"`) || !strings.Contains(got, `"accept":"*/*"`) {
+		t.Errorf("encoded headers = %s, want x-secret redacted and accept logged", got)
+	}
+}
+
+func TestMiddlewareIDSharedOption(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	mw := NewConnectionMiddleware(zap.New(core), WithMiddlewareID(""))
+	mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if logs.Len() != 2 {
+		t.Fatalf("%d lines were logged, want the connection and request lines", logs.Len())
+	}
+	conn, _ := logs.All()[0].ContextMap()["middlewareID"].(string)
+	req, _ := logs.All()[1].ContextMap()["middlewareID"].(string)
+	if conn == "" || conn != req {
+		t.Errorf("middlewareIDs = %q and %q, want the same generated UUID", conn, req)
+	}
+}
+
+func TestMiddlewareAdaptiveBodyCaptureZeroIncidentLimit(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithAdaptiveBodyCapture(4, 0, 0, time.Minute))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("0123456789"))
+	}))
+
+	// During the incident, the base limit is still used rather than no limit.
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	if logs.Len() != 2 {
+		t.Fatalf("%d lines were logged, want 2", logs.Len())
+	}
+	for i, e := range logs.All() {
+		httpResp, _ := e.ContextMap()["httpResponse"].(map[string]interface{})
+		if got := httpResp["body"]; got != "0123" {
+			t.Errorf("request %d: httpResponse[%q] = %v, want %q", i, "body", got, "0123")
+		}
+	}
+}
+
+func TestMiddlewareIngressHeaders(t *testing.T) {
+	tests := []struct {
+		desc    string
+		enabled bool
+		wantURL string
+	}{
+		{desc: "enabled", enabled: true, wantURL: "http://public.example.com/api/users?id=1"},
+		{desc: "disabled", enabled: false, wantURL: "http://internal:8080/users"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithIngressHeaders(test.enabled))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(http.MethodGet, "http://internal:8080/users", nil)
+			req.Header.Set("X-Forwarded-Host", "public.example.com")
+			req.Header.Set("X-Original-URL", "/api/users?id=1")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got := loggedObject(t, logs, "httpRequest")["requestURL"]; got != test.wantURL {
+				t.Errorf("httpRequest[%q] = %v, want %q", "requestURL", got, test.wantURL)
+			}
+		})
+	}
+}
+
+func TestMiddlewareDefaultFields(t *testing.T) {
+	tests := []struct {
+		desc       string
+		middleware func(*zap.Logger) Middleware
+		want       map[string]interface{}
+	}{
+		{
+			desc: "default fields accumulate",
+			middleware: func(l *zap.Logger) Middleware {
+				return NewMiddleware(l, WithDefaultFields(zap.String("service", "api")), WithDefaultFields(zap.Int("shard", 2)))
+			},
+			want: map[string]interface{}{"service": "api", "shard": int64(2)},
+		},
+		{
+			desc: "group",
+			middleware: func(l *zap.Logger) Middleware {
+				return NewGroupMiddleware(l, "api/v1", WithDefaultFields(zap.String("service", "api")))
+			},
+			want: map[string]interface{}{"service": "api", "routeGroup": "api/v1"},
+		},
+		{
+			desc:       "none",
+			middleware: func(l *zap.Logger) Middleware { return NewMiddleware(l) },
+			want:       map[string]interface{}{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := test.middleware(zap.New(core))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if logs.Len() != 1 {
+				t.Fatalf("%d lines were logged, want 1", logs.Len())
+			}
+			got := logs.All()[0].ContextMap()
+			delete(got, "httpRequest")
+			delete(got, "httpResponse")
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("top-level fields = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareErrorResponseParser(t *testing.T) {
+	parser := func(contentType string, body []byte) (string, string) {
+		var resp struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		if contentType != "application/json" || json.Unmarshal(body, &resp) != nil {
+			return "", ""
+		}
+		return resp.Code, resp.Message
+	}
+	tests := []struct {
+		desc        string
+		status      int
+		body        string
+		wantCode    interface{}
+		wantMessage interface{}
+	}{
+		{
+			desc:        "error",
+			status:      http.StatusBadRequest,
+			body:        `{"code":"INVALID_EMAIL","message":"email is invalid"}`,
+			wantCode:    "INVALID_EMAIL",
+			wantMessage: "email is invalid",
+		},
+		{
+			desc:   "empty values",
+			status: http.StatusBadRequest,
+			body:   `{}`,
+		},
+		{
+			desc:   "success",
+			status: http.StatusOK,
+			body:   `{"code":"OK","message":"fine"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithErrorResponseParser(parser))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			httpResp := loggedObject(t, logs, "httpResponse")
+			if got := httpResp["errorCode"]; got != test.wantCode {
+				t.Errorf("httpResponse[%q] = %v, want %v", "errorCode", got, test.wantCode)
+			}
+			if got := httpResp["errorMessage"]; got != test.wantMessage {
+				t.Errorf("httpResponse[%q] = %v, want %v", "errorMessage", got, test.wantMessage)
+			}
+		})
+	}
+}
+
+func TestMiddlewareLogHooks(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	var calls []string
+	hook := func(name string) func(*http.Request, int, time.Duration) {
+		return func(r *http.Request, status int, elapsed time.Duration) {
+			calls = append(calls, fmt.Sprintf("%s %s %d, %d lines logged", name, r.URL.Path, status, logs.Len()))
+		}
+	}
+	h := NewMiddleware(zap.New(core), WithPreLogHook(hook("pre")), WithPostLogHook(hook("post")))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/users", nil))
+
+	want := []string{"pre /users 201, 0 lines logged", "post /users 201, 1 lines logged"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("hook calls = %q, want %q", calls, want)
+	}
+}
+
+// pushRecorderWriter is an HTTP/2 response writer that records server pushes.
+type pushRecorderWriter struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (p *pushRecorderWriter) Push(target string, _ *http.PushOptions) error {
+	p.pushed = append(p.pushed, target)
+	return nil
+}
+
+func TestMiddlewareH2PushLogging(t *testing.T) {
+	tests := []struct {
+		desc    string
+		enabled bool
+		want    interface{}
+	}{
+		{desc: "enabled", enabled: true, want: []interface{}{"/app.css", "/app.js"}},
+		{desc: "disabled", enabled: false, want: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithH2PushLogging(test.enabled))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				pusher, ok := w.(http.Pusher)
+				if !ok {
+					t.Fatal("response writer doesn't implement http.Pusher")
+				}
+				pusher.Push("/app.css", nil)
+				pusher.Push("/app.js", nil)
+			}))
+			w := &pushRecorderWriter{ResponseRecorder: httptest.NewRecorder()}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.ProtoMajor, req.ProtoMinor, req.Proto = 2, 0, "HTTP/2.0"
+			h.ServeHTTP(w, req)
+
+			if len(w.pushed) != 2 {
+				t.Errorf("%d pushes reached the client, want 2", len(w.pushed))
+			}
+			if got := loggedObject(t, logs, "httpResponse")["pushedResources"]; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("httpResponse[%q] = %v, want %v", "pushedResources", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareTenantLogger(t *testing.T) {
+	defaultCore, defaultLogs := observer.New(zapcore.DebugLevel)
+	tenantCore, tenantLogs := observer.New(zapcore.DebugLevel)
+	tenantLogger := zap.New(tenantCore)
+	h := NewMiddleware(zap.New(defaultCore),
+		WithTenantLogger(func(r *http.Request) *zap.Logger {
+			if r.Header.Get("X-Tenant") == "acme" {
+				return tenantLogger
+			}
+			return nil
+		}),
+		WithDefaultFields(zap.String("service", "api")),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		tenant      string
+		wantDefault int
+		wantTenant  int
+	}{
+		{tenant: "acme", wantDefault: 0, wantTenant: 1},
+		{tenant: "other", wantDefault: 1, wantTenant: 1},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Tenant", test.tenant)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		if defaultLogs.Len() != test.wantDefault || tenantLogs.Len() != test.wantTenant {
+			t.Errorf("after a request for %q, default and tenant loggers have %d and %d lines, want %d and %d", test.tenant, defaultLogs.Len(), tenantLogs.Len(), test.wantDefault, test.wantTenant)
+		}
+	}
+	if got := tenantLogs.All()[0].ContextMap()["service"]; got != "api" {
+		t.Errorf("tenant log line field %q = %v, want %q", "service", got, "api")
+	}
+}
+
+func TestMiddlewareBodyContentTypeAllowList(t *testing.T) {
+	tests := []struct {
+		desc        string
+		allowList   []string
+		contentType string
+		want        interface{}
+	}{
+		{desc: "allowed", allowList: []string{"application/json"}, contentType: "application/json; charset=utf-8", want: "oops"},
+		{desc: "not allowed", allowList: []string{"application/json"}, contentType: "text/html", want: ""},
+		{desc: "no allow list", contentType: "text/html", want: "oops"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithBodyContentTypeAllowList(test.allowList))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", test.contentType)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("oops"))
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if got := loggedObject(t, logs, "httpResponse")["body"]; got != test.want {
+				t.Errorf("httpResponse[%q] = %v, want %v", "body", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareRequestLog(t *testing.T) {
+	tests := []struct {
+		desc    string
+		options []Option
+		want    []zapcore.Level
+	}{
+		{desc: "enabled", options: []Option{WithRequestLog(zapcore.DebugLevel)}, want: []zapcore.Level{zapcore.DebugLevel, zapcore.InfoLevel}},
+		{desc: "disabled", want: []zapcore.Level{zapcore.InfoLevel}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			var linesInHandler int
+			h := NewMiddleware(zap.New(core), test.options...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				linesInHandler = logs.Len()
+				w.WriteHeader(http.StatusOK)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users", nil))
+
+			var got []zapcore.Level
+			for _, e := range logs.All() {
+				got = append(got, e.Level)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("logged lines at %v, want %v", got, test.want)
+			}
+			if linesInHandler != len(test.want)-1 {
+				t.Errorf("%d lines were logged before the handler ran, want %d", linesInHandler, len(test.want)-1)
+			}
+			if len(got) == 2 {
+				start := logs.All()[0].ContextMap()
+				httpReq, _ := start["httpRequest"].(map[string]interface{})
+				if start["event"] != "incoming" || httpReq["requestPath"] != "/users" {
+					t.Errorf("request start line fields = %v, want event %q and the request", start, "incoming")
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewarePathNormalizer(t *testing.T) {
+	tests := []struct {
+		desc       string
+		normalizer func(*http.Request) string
+		path       string
+		want       string
+	}{
+		{desc: "chi pattern", normalizer: ChiPatternNormalizer, path: "/users/123", want: "/users/{userID}"},
+		{desc: "chi pattern unmatched", normalizer: ChiPatternNormalizer, path: "/unknown/123", want: "/unknown/123"},
+		{desc: "custom", normalizer: func(r *http.Request) string { return strings.ToUpper(r.URL.Path) }, path: "/users/123", want: "/USERS/123"},
+		{desc: "unset", path: "/users/123", want: "/users/123"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			r := chi.NewRouter()
+			r.Use(NewMiddleware(zap.New(core), WithPathNormalizer(test.normalizer)))
+			r.Get("/users/{userID}", func(w http.ResponseWriter, r *http.Request) {})
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			if got := loggedObject(t, logs, "httpRequest")["requestPath"]; got != test.want {
+				t.Errorf("httpRequest[%q] = %v, want %q", "requestPath", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareBodyLogFormat(t *testing.T) {
+	binary := []byte{0xff, 0x00, 'h', 'i'}
+	tests := []struct {
+		desc   string
+		format BodyLogFormat
+		body   []byte
+		want   string
+	}{
+		{desc: "default", body: []byte("oops"), want: "oops"},
+		{desc: "hex", format: BodyLogHex, body: binary, want: "ff006869"},
+		{desc: "base64", format: BodyLogBase64, body: []byte("oops"), want: "b29wcw=="},
+		{desc: "auto text", format: BodyLogAuto, body: []byte("oops"), want: "oops"},
+		{desc: "auto binary", format: BodyLogAuto, body: binary, want: "/wBoaQ=="},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithBodyLogFormat(test.format))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write(test.body)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if got := loggedObject(t, logs, "httpResponse")["body"]; got != test.want {
+				t.Errorf("httpResponse[%q] = %q, want %q", "body", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareLogCookieNames(t *testing.T) {
+	tests := []struct {
+		desc    string
+		enabled bool
+		want    interface{}
+	}{
+		{desc: "enabled", enabled: true, want: []interface{}{"session", "theme"}},
+		{desc: "disabled", enabled: false, want: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithLogCookieNames(test.enabled))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Cookie", "session=secret-token; theme=dark")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			header, _ := loggedObject(t, logs, "httpRequest")["header"].(map[string]interface{})
+			if got := header["cookieNames"]; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("header[%q] = %v, want %v", "cookieNames", got, test.want)
+			}
+			if got := header["cookie"]; got != "***" {
+				t.Errorf("header[%q] = %v, want %q", "cookie", got, "***")
+			}
+		})
+	}
+}
+
+func TestCorrelationMiddleware(t *testing.T) {
+	generatedRE := regexp.MustCompile(`^[0-9a-f]{32}$`)
+	tests := []struct {
+		desc   string
+		header string
+		match  func(string) bool
+	}{
+		{desc: "from header", header: "abc123", match: func(id string) bool { return id == "abc123" }},
+		{desc: "generated", match: generatedRE.MatchString},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			var gotID string
+			h := NewCorrelationMiddleware(zap.New(core))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotID = GetCorrelationID(r.Context())
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.header != "" {
+				req.Header.Set(CorrelationIDHeader, test.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if !test.match(gotID) {
+				t.Errorf("GetCorrelationID() = %q, want %q or a generated ID if empty", gotID, test.header)
+			}
+			if got := rec.Header().Get(CorrelationIDHeader); got != gotID {
+				t.Errorf("response %s header = %q, want %q", CorrelationIDHeader, got, gotID)
+			}
+			if got := loggedObject(t, logs, "httpRequest")["correlationID"]; got != gotID {
+				t.Errorf("httpRequest[%q] = %v, want %q", "correlationID", got, gotID)
+			}
+		})
+	}
+
+	if got := GetCorrelationID(context.Background()); got != "" {
+		t.Errorf("GetCorrelationID() without the middleware = %q, want empty", got)
+	}
+}
+
+func TestMiddlewareOpenAPIOperationID(t *testing.T) {
+	operations := map[string]string{"GET /users/{userID}": "getUser"}
+	lookup := func(method, pattern string) string { return operations[method+" "+pattern] }
+	tests := []struct {
+		desc   string
+		lookup func(method, pattern string) string
+		method string
+		want   interface{}
+	}{
+		{desc: "found", lookup: lookup, method: http.MethodGet, want: "getUser"},
+		{desc: "not found", lookup: lookup, method: http.MethodDelete, want: nil},
+		{desc: "noop", lookup: NoopOperationIDLookup, method: http.MethodGet, want: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			r := chi.NewRouter()
+			r.Use(NewMiddleware(zap.New(core), WithOpenAPIOperationID(test.lookup)))
+			r.Get("/users/{userID}", func(w http.ResponseWriter, r *http.Request) {})
+			r.Delete("/users/{userID}", func(w http.ResponseWriter, r *http.Request) {})
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(test.method, "/users/123", nil))
+
+			if got := loggedObject(t, logs, "httpRequest")["operationId"]; got != test.want {
+				t.Errorf("httpRequest[%q] = %v, want %v", "operationId", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareStructuredQueryParams(t *testing.T) {
+	tests := []struct {
+		desc    string
+		options []Option
+		target  string
+		want    interface{}
+	}{
+		{
+			desc:    "enabled",
+			options: []Option{WithStructuredQueryParams([]string{"Token"})},
+			target:  "/?q=go&token=secret&q=chi",
+			want: []interface{}{
+				map[string]interface{}{"key": "q", "value": "go"},
+				map[string]interface{}{"key": "q", "value": "chi"},
+				map[string]interface{}{"key": "token", "value": "***"},
+			},
+		},
+		{
+			desc:    "no query",
+			options: []Option{WithStructuredQueryParams(nil)},
+			target:  "/",
+			want:    nil,
+		},
+		{
+			desc:   "disabled",
+			target: "/?q=go",
+			want:   nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), test.options...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, test.target, nil))
+
+			if got := loggedObject(t, logs, "httpRequest")["queryParams"]; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("httpRequest[%q] = %v, want %v", "queryParams", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareRequestID(t *testing.T) {
+	generator := WithReqIDGenerator(func(*http.Request) string { return "generated" })
+	setOuter := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(SetRequestID(r.Context(), "outer")))
+		})
+	}
+	tests := []struct {
+		desc    string
+		options []Option
+		// wrap, if set, wraps the middleware.
+		wrap func(http.Handler) http.Handler
+		// want is the ID returned by GetRequestID in the handler. The logged ID
+		// is the same, unless chi's middleware.RequestID assigned one.
+		want string
+	}{
+		{desc: "generated", options: []Option{generator}, want: "generated"},
+		{desc: "set by an outer middleware", options: []Option{generator}, wrap: setOuter, want: "outer"},
+		{desc: "chi request ID", options: []Option{generator}, wrap: middleware.RequestID, want: ""},
+		{desc: "none", want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			var got, chiID string
+			var h http.Handler = NewMiddleware(zap.New(core), test.options...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, chiID = GetRequestID(r.Context()), middleware.GetReqID(r.Context())
+			}))
+			if test.wrap != nil {
+				h = test.wrap(h)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if got != test.want {
+				t.Errorf("GetRequestID() = %q, want %q", got, test.want)
+			}
+			var wantLogged interface{}
+			if chiID != "" {
+				wantLogged = chiID
+			} else if test.want != "" {
+				wantLogged = test.want
+			}
+			if logged := loggedObject(t, logs, "httpRequest")["requestID"]; logged != wantLogged {
+				t.Errorf("httpRequest[%q] = %v, want %v", "requestID", logged, wantLogged)
+			}
+		})
+	}
+}
+
+var perfTestSink []byte
+
+func TestMiddlewarePerformanceProfile(t *testing.T) {
+	tests := []struct {
+		desc    string
+		enabled bool
+	}{
+		{desc: "enabled", enabled: true},
+		{desc: "disabled", enabled: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithPerformanceProfile(test.enabled))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				perfTestSink = make([]byte, 1<<20)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			stats, ok := loggedObject(t, logs, "httpResponse")["perfStats"].(map[string]interface{})
+			if ok != test.enabled {
+				t.Fatalf("perfStats logged = %t, want %t", ok, test.enabled)
+			}
+			if !test.enabled {
+				return
+			}
+			if got, _ := stats["totalAllocDelta"].(uint64); got < 1<<20 {
+				t.Errorf("perfStats.totalAllocDelta = %v, want at least %d", stats["totalAllocDelta"], 1<<20)
+			}
+			for _, k := range []string{"heapAllocDelta", "numGCDelta"} {
+				if _, ok := stats[k]; !ok {
+					t.Errorf("perfStats[%q] wasn't logged", k)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareClientCertLogging(t *testing.T) {
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	cert := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "client.example.com"},
+		Issuer:       pkix.Name{CommonName: "Example CA"},
+		SerialNumber: big.NewInt(0xabc123),
+		NotAfter:     expiry,
+	}
+	tests := []struct {
+		desc    string
+		enabled bool
+		state   *tls.ConnectionState
+		want    map[string]interface{}
+	}{
+		{
+			desc:    "enabled",
+			enabled: true,
+			state:   &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+			want: map[string]interface{}{
+				"clientCertSubject": "CN=client.example.com",
+				"clientCertIssuer":  "CN=Example CA",
+				"clientCertSerial":  "abc123",
+				"clientCertExpiry":  expiry,
+			},
+		},
+		{desc: "no certificate", enabled: true, state: &tls.ConnectionState{}},
+		{desc: "disabled", state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithClientCertLogging(test.enabled))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req.TLS = test.state
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			httpReq := loggedObject(t, logs, "httpRequest")
+			for _, k := range []string{"clientCertSubject", "clientCertIssuer", "clientCertSerial", "clientCertExpiry"} {
+				if got, want := httpReq[k], test.want[k]; got != want {
+					t.Errorf("httpRequest[%q] = %v, want %v", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareRequestCountHeader(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithRequestCountHeader("X-Conn-Requests"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		remoteAddr string
+		want       int64
+	}{
+		{remoteAddr: "10.0.0.1:1234", want: 1},
+		{remoteAddr: "10.0.0.1:1234", want: 2},
+		{remoteAddr: "10.0.0.2:5678", want: 1},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if got, want := rec.Header().Get("X-Conn-Requests"), strconv.FormatInt(test.want, 10); got != want {
+			t.Errorf("request %d: X-Conn-Requests = %q, want %q", i, got, want)
+		}
+		httpReq, _ := logs.TakeAll()[0].ContextMap()["httpRequest"].(map[string]interface{})
+		if got := httpReq["connRequestCount"]; got != test.want {
+			t.Errorf("request %d: httpRequest[%q] = %v, want %d", i, "connRequestCount", got, test.want)
+		}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		core, logs := observer.New(zapcore.DebugLevel)
+		rec := httptest.NewRecorder()
+		NewMiddleware(zap.New(core))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if _, ok := loggedObject(t, logs, "httpRequest")["connRequestCount"]; ok {
+			t.Error("connRequestCount was logged without WithRequestCountHeader")
+		}
+	})
+}
+
+func TestMiddlewareExtraLoggers(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	extraCore, extraLogs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core),
+		WithExtraLoggers(zap.New(extraCore)),
+		WithDefaultFields(zap.String("service", "api")),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing", nil))
+
+	if logs.Len() != 1 || extraLogs.Len() != 1 {
+		t.Fatalf("logged %d and %d lines to the main and extra loggers, want 1 each", logs.Len(), extraLogs.Len())
+	}
+	got, want := extraLogs.All()[0], logs.All()[0]
+	if got.Message != want.Message || got.Level != want.Level {
+		t.Errorf("extra logger got %q at %v, want %q at %v", got.Message, got.Level, want.Message, want.Level)
+	}
+	if !reflect.DeepEqual(got.ContextMap(), want.ContextMap()) {
+		t.Errorf("extra logger fields = %v, want %v", got.ContextMap(), want.ContextMap())
+	}
+}
+
+func TestMiddlewareContextDeadlineLogging(t *testing.T) {
+	tests := []struct {
+		desc         string
+		enabled      bool
+		timeout      time.Duration
+		wantExceeded interface{}
+	}{
+		{desc: "met", enabled: true, timeout: time.Hour, wantExceeded: nil},
+		{desc: "exceeded", enabled: true, timeout: time.Millisecond, wantExceeded: true},
+		{desc: "disabled", enabled: false, timeout: time.Millisecond, wantExceeded: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithContextDeadlineLogging(test.enabled))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.timeout < time.Second {
+					<-r.Context().Done()
+				}
+			}))
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+			deadline, _ := ctx.Deadline()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+
+			logged, _ := loggedObject(t, logs, "httpRequest")["contextDeadline"].(string)
+			if test.enabled {
+				if got, err := time.Parse(time.RFC3339Nano, logged); err != nil || !got.Equal(deadline) {
+					t.Errorf("httpRequest[%q] = %q, want %v", "contextDeadline", logged, deadline)
+				}
+			} else if logged != "" {
+				t.Errorf("httpRequest[%q] = %q, want it unset", "contextDeadline", logged)
+			}
+			if got := loggedObject(t, logs, "httpResponse")["deadlineExceeded"]; got != test.wantExceeded {
+				t.Errorf("httpResponse[%q] = %v, want %v", "deadlineExceeded", got, test.wantExceeded)
+			}
+		})
+	}
+}
+
+func TestMiddlewareResponseBodyCondition(t *testing.T) {
+	created := func(status int) bool { return status == http.StatusCreated }
+	tests := []struct {
+		desc    string
+		options []Option
+		status  int
+		want    interface{}
+	}{
+		{desc: "condition matches", options: []Option{WithResponseBodyCondition(created)}, status: http.StatusCreated, want: "body"},
+		{desc: "condition doesn't match", options: []Option{WithResponseBodyCondition(created)}, status: http.StatusOK, want: nil},
+		{desc: "default", status: http.StatusCreated, want: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), test.options...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				w.Write([]byte("body"))
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+
+			if got := loggedObject(t, logs, "httpResponse")["body"]; got != test.want {
+				t.Errorf("httpResponse[%q] = %v, want %v", "body", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHealthCheckMiddleware(t *testing.T) {
+	tests := []struct {
+		path      string
+		wantLevel zapcore.Level
+		wantSkip  bool
+	}{
+		{path: "/healthz", wantLevel: zapcore.DebugLevel, wantSkip: true},
+		{path: "/users", wantLevel: zapcore.InfoLevel, wantSkip: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			var skip bool
+			h := NewHealthCheckMiddleware(zap.New(core), []string{"/healthz"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				skip = SkipMetrics(r.Context())
+				w.WriteHeader(http.StatusOK)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			if skip != test.wantSkip {
+				t.Errorf("SkipMetrics() = %t, want %t", skip, test.wantSkip)
+			}
+			if logs.Len() != 1 {
+				t.Fatalf("%d lines were logged, want 1", logs.Len())
+			}
+			if got := logs.All()[0].Level; got != test.wantLevel {
+				t.Errorf("logged at %v, want %v", got, test.wantLevel)
+			}
+		})
+	}
+}
+
+func TestMiddlewareStatusCodeTranslation(t *testing.T) {
+	tests := []struct {
+		desc      string
+		options   []Option
+		wantMsg   string
+		wantLevel zapcore.Level
+	}{
+		{
+			desc:      "translated",
+			options:   []Option{WithStatusCodeTranslation(map[int]int{499: http.StatusOK})},
+			wantMsg:   "GET / - 499 OK",
+			wantLevel: zapcore.InfoLevel,
+		},
+		{
+			desc:      "untranslated",
+			wantMsg:   "GET / - 499 Client Error",
+			wantLevel: zapcore.WarnLevel,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), test.options...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(499)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if got := loggedObject(t, logs, "httpResponse")["status"]; got != 499 {
+				t.Errorf("httpResponse[%q] = %v, want 499", "status", got)
+			}
+			if e := logs.All()[0]; e.Message != test.wantMsg || e.Level != test.wantLevel {
+				t.Errorf("logged %q at %v, want %q at %v", e.Message, e.Level, test.wantMsg, test.wantLevel)
+			}
+		})
+	}
+}
+
+func TestMiddlewareDurationBudgetFunc(t *testing.T) {
+	tests := []struct {
+		desc         string
+		budget       time.Duration
+		sleep        time.Duration
+		wantExceeded interface{}
+		wantPct      bool
+	}{
+		{desc: "within budget", budget: time.Hour, wantPct: true},
+		{desc: "over budget", budget: time.Nanosecond, sleep: time.Millisecond, wantExceeded: true, wantPct: true},
+		{desc: "no budget", budget: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithDurationBudgetFunc(func(*http.Request) time.Duration { return test.budget }))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(test.sleep)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			httpResp := loggedObject(t, logs, "httpResponse")
+			pct, ok := httpResp["budgetConsumedPct"].(float64)
+			if ok != test.wantPct {
+				t.Errorf("httpResponse[%q] = %v, want it logged: %t", "budgetConsumedPct", httpResp["budgetConsumedPct"], test.wantPct)
+			}
+			if test.wantExceeded != nil && pct <= 100 {
+				t.Errorf("httpResponse[%q] = %v, want over 100", "budgetConsumedPct", pct)
+			}
+			if got := httpResp["budgetExceeded"]; got != test.wantExceeded {
+				t.Errorf("httpResponse[%q] = %v, want %v", "budgetExceeded", got, test.wantExceeded)
+			}
+		})
+	}
+}
+
+func TestMiddlewareChiURLParams(t *testing.T) {
+	tests := []struct {
+		desc    string
+		options []Option
+		want    interface{}
+	}{
+		{
+			desc:    "enabled",
+			options: []Option{WithChiURLParams(true)},
+			want:    map[string]interface{}{"userID": "123", "token": "secret"},
+		},
+		{
+			desc:    "redacted",
+			options: []Option{WithChiURLParams(true), WithURLParamRedactor(func(key, _ string) bool { return key == "token" })},
+			want:    map[string]interface{}{"userID": "123", "token": "***"},
+		},
+		{
+			desc: "disabled",
+			want: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			r := chi.NewRouter()
+			r.Use(NewMiddleware(zap.New(core), test.options...))
+			r.Get("/users/{userID}/tokens/{token}", func(w http.ResponseWriter, r *http.Request) {})
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/123/tokens/secret", nil))
+
+			if got := loggedObject(t, logs, "httpRequest")["urlParams"]; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("httpRequest[%q] = %v, want %v", "urlParams", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareLogID(t *testing.T) {
+	tests := []struct {
+		desc    string
+		enabled bool
+		want    []interface{}
+	}{
+		{desc: "enabled", enabled: true, want: []interface{}{uint64(1), uint64(2), uint64(3)}},
+		{desc: "disabled", enabled: false, want: []interface{}{nil, nil, nil}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithLogID(test.enabled))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			for range test.want {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			}
+
+			var got []interface{}
+			for _, e := range logs.All() {
+				got = append(got, e.ContextMap()["logSeq"])
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("logSeq values = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareDefaultStatus(t *testing.T) {
+	tests := []struct {
+		desc      string
+		options   []Option
+		wantMsg   string
+		wantLevel zapcore.Level
+	}{
+		{
+			desc:      "set",
+			options:   []Option{WithDefaultStatus(http.StatusOK)},
+			wantMsg:   "GET / - 0 OK",
+			wantLevel: zapcore.InfoLevel,
+		},
+		{
+			desc:      "unset",
+			wantMsg:   "GET / - 0 Unknown",
+			wantLevel: zapcore.WarnLevel,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), test.options...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if got := loggedObject(t, logs, "httpResponse")["status"]; got != 0 {
+				t.Errorf("httpResponse[%q] = %v, want 0", "status", got)
+			}
+			if e := logs.All()[0]; e.Message != test.wantMsg || e.Level != test.wantLevel {
+				t.Errorf("logged %q at %v, want %q at %v", e.Message, e.Level, test.wantMsg, test.wantLevel)
+			}
+		})
+	}
+}
+
+func TestMiddlewareHeadersObjectName(t *testing.T) {
+	tests := []struct {
+		desc     string
+		options  []Option
+		wantReq  string
+		wantResp string
+	}{
+		{desc: "custom", options: []Option{WithHeadersObjectName("headers", "respHeaders")}, wantReq: "headers", wantResp: "respHeaders"},
+		{desc: "default", wantReq: "header", wantResp: "header"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), test.options...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Served-By", "test")
+				w.WriteHeader(http.StatusOK)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept", "*/*")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			reqHeader, _ := loggedObject(t, logs, "httpRequest")[test.wantReq].(map[string]interface{})
+			if got := reqHeader["accept"]; got != "*/*" {
+				t.Errorf("httpRequest[%q][%q] = %v, want %q", test.wantReq, "accept", got, "*/*")
+			}
+			respHeader, _ := loggedObject(t, logs, "httpResponse")[test.wantResp].(map[string]interface{})
+			if got := respHeader["x-served-by"]; got != "test" {
+				t.Errorf("httpResponse[%q][%q] = %v, want %q", test.wantResp, "x-served-by", got, "test")
+			}
+		})
+	}
+}
+
+func TestMiddlewareRedactedQueryNotLogged(t *testing.T) {
+	for _, ecs := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ecs=%t", ecs), func(t *testing.T) {
+			var logged, accessLog bytes.Buffer
+			logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&logged), zapcore.DebugLevel))
+			h := NewMiddleware(logger,
+				WithStructuredQueryParams([]string{"Token"}),
+				WithAccessLogWriter(&accessLog),
+				WithElasticCommonSchema(ecs),
+			)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/search?q=go&TOKEN=raw-secret-value", nil))
+
+			for name, got := range map[string]string{"log": logged.String(), "access log": accessLog.String()} {
+				if got == "" {
+					t.Errorf("nothing written to the %s", name)
+				}
+				if strings.Contains(got, "raw-secret-value") {
+					t.Errorf("%s %s contains the redacted query parameter's value", name, got)
+				}
+				if !strings.Contains(got, "/search?q=go&TOKEN=***") {
+					t.Errorf("%s %s doesn't contain the redacted query", name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareTeeWriter(t *testing.T) {
+	tests := []struct {
+		desc     string
+		status   int
+		wantBody interface{}
+	}{
+		{desc: "success", status: http.StatusOK, wantBody: nil},
+		{desc: "error", status: http.StatusNotFound, wantBody: "not found"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			var tee bytes.Buffer
+			core, logs := observer.New(zapcore.DebugLevel)
+			h := NewMiddleware(zap.New(core), WithTeeWriter(&tee))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				w.Write([]byte("not "))
+				w.Write([]byte("found"))
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if got := tee.String(); got != "not found" {
+				t.Errorf("tee writer got %q, want %q", got, "not found")
+			}
+			if got := loggedObject(t, logs, "httpResponse")["body"]; got != test.wantBody {
+				t.Errorf("httpResponse[%q] = %v, want %v", "body", got, test.wantBody)
+			}
+		})
+	}
+}
+
+func TestMiddlewareBodyCaptureMaxAge(t *testing.T) {
+	tests := []struct {
+		desc     string
+		maxAge   time.Duration
+		wantBody string
+		wantSeen string
+	}{
+		{
+			desc:     "fast handler",
+			maxAge:   time.Hour,
+			wantBody: `{"error":"boom"}`,
+			wantSeen: `{"error":"boom"}`,
+		},
+		{
+			desc:     "slow handler",
+			maxAge:   time.Nanosecond,
+			wantBody: skippedSlowBody,
+			wantSeen: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			var parsed, metered []byte
+			h := NewMiddleware(zap.New(core),
+				WithBodyCaptureMaxAge(test.maxAge),
+				WithErrorResponseParser(func(_ string, body []byte) (string, string) { parsed = body; return "", "" }),
+				WithRequestMeter(func(_ *http.Request, body []byte) (int, int) { metered = body; return 0, 0 }),
+			)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":"boom"}`))
+				time.Sleep(time.Millisecond)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if got := loggedObject(t, logs, "httpResponse")["body"]; got != test.wantBody {
+				t.Errorf("httpResponse[%q] = %v, want %q", "body", got, test.wantBody)
+			}
+			if string(parsed) != test.wantSeen || string(metered) != test.wantSeen {
+				t.Errorf("ErrorResponseParser and RequestMeter got bodies %q and %q, want %q", parsed, metered, test.wantSeen)
+			}
+		})
+	}
+}
+
+func TestMiddlewareTeeWriterPastCaptureLimit(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 1000)
+	var tee bytes.Buffer
+	var n int
+	var writeErr error
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewMiddleware(zap.New(core), WithTeeWriter(&tee))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		n, writeErr = w.Write(body)
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if n != len(body) || writeErr != nil {
+		t.Errorf("handler Write() = %d, %v, want %d, nil", n, writeErr, len(body))
+	}
+	if !bytes.Equal(tee.Bytes(), body) {
+		t.Errorf("tee writer got %d bytes, want %d", tee.Len(), len(body))
+	}
+	if rec.Body.Len() != len(body) {
+		t.Errorf("client got %d bytes, want %d", rec.Body.Len(), len(body))
+	}
+	if got, _ := loggedObject(t, logs, "httpResponse")["body"].(string); len(got) != defaultBodyCaptureLimit {
+		t.Errorf("logged body is %d bytes, want %d", len(got), defaultBodyCaptureLimit)
+	}
+}
+
+func TestMiddlewareMetricsTagExtractor(t *testing.T) {
+	tests := []struct {
+		desc string
+		fn   func(*http.Request) map[string]string
+		want interface{}
+	}{
+		{
+			desc: "route pattern",
+			fn: func(r *http.Request) map[string]string {
+				return map[string]string{"endpoint": chi.RouteContext(r.Context()).RoutePattern(), "version": "v1"}
+			},
+			want: map[string]interface{}{"endpoint": "/users/{userID}", "version": "v1"},
+		},
+		{
+			desc: "no tags",
+			fn:   func(*http.Request) map[string]string { return nil },
+			want: nil,
+		},
+		{
+			desc: "unset",
+			want: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			r := chi.NewRouter()
+			r.Use(NewMiddleware(zap.New(core), WithMetricsTagExtractor(test.fn)))
+			r.Get("/users/{userID}", func(w http.ResponseWriter, r *http.Request) {})
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/123", nil))
+
+			if got := loggedObject(t, logs, "httpRequest")["metricsTags"]; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("httpRequest[%q] = %v, want %v", "metricsTags", got, test.want)
 			}
 		})
 	}